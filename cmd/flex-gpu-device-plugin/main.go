@@ -17,6 +17,7 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
 	"github.com/WLBF/flex-gpu-device-plugin/device"
@@ -24,7 +25,9 @@ import (
 	"k8s.io/klog/v2"
 	"log"
 	"os"
+	"sync"
 	"syscall"
+	"time"
 
 	"github.com/fsnotify/fsnotify"
 	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
@@ -32,27 +35,203 @@ import (
 
 var version string // This should be set at build time to indicate the actual version
 
-var mock = flag.String("mock", "", "mock device memory size(MiB) array, e.g. '16384,8192,8192'")
+var mock = flag.String("mock", "", "mock device memory size array, in MiB without suffix, optionally followed by mig devices, e.g. '16Gi,8192Mi,40Gi/3g.20gb+1g.5gb'")
+var policy = flag.String("policy", device.PolicyBinpack, "memory allocation policy, one of 'binpack', 'spread' or 'index'")
+var ignoredXids = flag.String("ignored-xids", "13,31,43,45,68", "comma separated xids which do not mark a gpu unhealthy")
+var deviceIDStrategy = flag.String("device-id-strategy", device.DeviceIDIndex, "how gpus are referred to in device ids, one of 'index' or 'uuid'")
+var memoryUnit = flag.String("memory-unit", "1Gi", "size of a memory resource unit, e.g. '256Mi', '512Mi', '1Gi' or '2Gi'")
+var reservedMemory = flag.String("reserved-memory", "", "gpu memory not shared out as memory resources, e.g. '512Mi' or '5%'")
+var reservedMemoryPerModel = flag.String("reserved-memory-per-model", "", "per gpu model reserved memory overriding -reserved-memory, e.g. 'Tesla T4=512Mi,NVIDIA A100-SXM4-40GB=5%'")
+var overcommitRatio = flag.Float64("memory-overcommit-ratio", 1, "how many times the gpu memory is advertised as memory resources, 1 disables overcommit")
+var overcommitLimit = flag.String("memory-overcommit-limit", "", "cap of the overcommitted memory advertised per gpu, e.g. '48Gi', empty for no cap")
+var includeGPUs = flag.String("include-gpus", "", "comma separated gpus to advertise by index, uuid, pci bus id or product name glob, empty for all")
+var excludeGPUs = flag.String("exclude-gpus", "", "comma separated gpus never to advertise by index, uuid, pci bus id or product name glob")
+var exclusiveGPUs = flag.String("exclusive-gpus", "", "comma separated gpus offered only as nvidia.flex.com/gpu, by index, uuid, pci bus id or product name glob")
+var sharedGPUs = flag.String("shared-gpus", "", "comma separated gpus offered only as memory and core resources, by index, uuid, pci bus id or product name glob")
+var resourcePerModel = flag.Bool("resource-per-model", false, "advertise one gpu, one memory and one core resource per gpu model, e.g. 'nvidia.flex.com/t4-memory'")
+var modelRenames = flag.String("model-renames", "", "comma separated model names used by -resource-per-model, e.g. 'NVIDIA A100-SXM4-40GB=a100'")
+var maxMemoryDevices = flag.Int("max-memory-devices", 10000, "max number of memory resources of the node, the memory unit is coarsened to fit, 0 for no limit")
+var migConfig = flag.String("mig-config", "", "path of a json file declaring the mig devices of the gpus, applied at startup to the gpus not in use")
+var migDryRun = flag.Bool("mig-dry-run", false, "only log the mig reconfiguration planned from -mig-config")
+var discoveryRetries = flag.Int("discovery-retries", 5, "number of times a failed gpu discovery is retried with backoff")
+var visibleDevicesStrategy = flag.String("visible-devices-strategy", plugin.VisibleDevicesIndex, "how gpus are passed in NVIDIA_VISIBLE_DEVICES, one of 'index' or 'uuid'")
 
 func main() {
 	klog.InitFlags(nil)
 	flag.Parse()
 
-	var manager device.Manager
-	if len(*mock) != 0 {
-		manager = device.NewMockManager(*mock)
-	} else {
-		manager = device.NewGPUManager()
-	}
-
-	if err := start(manager); err != nil {
+	if err := run(); err != nil {
 		log.SetOutput(os.Stderr)
 		log.Printf("Error: %v", err)
 		os.Exit(1)
 	}
 }
 
-func start(manager device.Manager) error {
+func run() error {
+	p, err := device.NewPolicy(*policy)
+	if err != nil {
+		return err
+	}
+	if err := plugin.ValidateVisibleDevicesStrategy(*visibleDevicesStrategy); err != nil {
+		return err
+	}
+	xids, err := device.ParseXids(*ignoredXids)
+	if err != nil {
+		return err
+	}
+	unit, err := device.ParseMemoryUnit(*memoryUnit)
+	if err != nil {
+		return err
+	}
+	reserved, err := device.ParseReservation(*reservedMemory)
+	if err != nil {
+		return err
+	}
+	reservedByModel, err := device.ParseModelReservations(*reservedMemoryPerModel)
+	if err != nil {
+		return err
+	}
+	var limit device.Quantity
+	if len(*overcommitLimit) != 0 {
+		if limit, err = device.ParseQuantity(*overcommitLimit); err != nil {
+			return fmt.Errorf("invalid memory overcommit limit: %v", err)
+		}
+	}
+	include, err := device.ParseSelector(*includeGPUs)
+	if err != nil {
+		return err
+	}
+	exclude, err := device.ParseSelector(*excludeGPUs)
+	if err != nil {
+		return err
+	}
+	exclusiveSel, err := device.ParseSelector(*exclusiveGPUs)
+	if err != nil {
+		return err
+	}
+	sharedSel, err := device.ParseSelector(*sharedGPUs)
+	if err != nil {
+		return err
+	}
+	opts := device.Options{
+		DeviceIDStrategy:      *deviceIDStrategy,
+		MemoryUnit:            unit,
+		ReservedMemory:        reserved,
+		ReservedMemoryByModel: reservedByModel,
+		OvercommitRatio:       *overcommitRatio,
+		OvercommitLimit:       limit,
+		MaxMemoryDevs:         *maxMemoryDevices,
+		Filter:                device.Filter{Include: include, Exclude: exclude},
+		ExclusiveGPUs:         exclusiveSel,
+		SharedGPUs:            sharedSel,
+	}
+	if err := opts.Validate(); err != nil {
+		return err
+	}
+
+	manager, err := newManager(opts)
+	if err != nil {
+		return err
+	}
+	// Deferred calls run in reverse order: background workers are stopped
+	// and waited for before the manager shuts NVML down.
+	defer func() {
+		log.Println("Shutting down device manager.")
+		if err := manager.Close(); err != nil {
+			log.Printf("Failed to shut down device manager: %v", err)
+		}
+	}()
+
+	if len(*migConfig) != 0 {
+		if err := reconcileMig(manager); err != nil {
+			return err
+		}
+	}
+
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	defer wg.Wait()
+	defer close(stop)
+
+	src, err := manager.NewEventSource()
+	if err != nil {
+		log.Printf("Failed to start health check, gpus stay healthy: %v", err)
+	} else {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer src.Close()
+			device.CheckHealth(manager, src, xids, stop)
+		}()
+	}
+
+	renames, err := plugin.ParseModelRenames(*modelRenames)
+	if err != nil {
+		return err
+	}
+
+	ledger := device.NewLedger()
+	go plugin.SyncLedger(ledger, manager, plugin.PodResourcesSocket, plugin.PodResourcesSyncInterval, stop)
+
+	return start(manager, renames, ledger, p)
+}
+
+// newManager returns the mock manager if requested, the GPU manager otherwise.
+// GPU discovery is retried with backoff unless the options are invalid, and
+// falls back to a manager without devices when the driver is missing so that
+// the plugin stays up.
+func newManager(opts device.Options) (*device.GPUManager, error) {
+	if len(*mock) != 0 {
+		return device.NewMockManager(*mock, opts)
+	}
+
+	backoff := time.Second
+	for attempt := 0; ; attempt++ {
+		manager, err := device.NewGPUManager(opts)
+		if err == nil {
+			return manager, nil
+		}
+		if errors.Is(err, device.ErrNoDriver) {
+			log.Printf("No usable gpu on this node, advertising zero devices: %v", err)
+			return device.NewEmptyManager(), nil
+		}
+		if errors.Is(err, device.ErrInvalidConfig) {
+			return nil, err
+		}
+		if attempt >= *discoveryRetries {
+			return nil, fmt.Errorf("gpu discovery failed after %d attempts: %w", attempt+1, err)
+		}
+		log.Printf("GPU discovery failed, retrying in %v: %v", backoff, err)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// reconcileMig repartitions the gpus not in use into the mig devices declared
+// in -mig-config. The device plugins are started afterwards and register the
+// resources of the new mig devices.
+func reconcileMig(manager *device.GPUManager) error {
+	config, err := device.LoadMigConfig(*migConfig)
+	if err != nil {
+		return err
+	}
+	inUse, err := plugin.GPUsInUse(manager, plugin.PodResourcesSocket)
+	if err != nil {
+		log.Printf("Skipping mig reconfiguration, unable to tell which gpus are in use: %v", err)
+		return nil
+	}
+
+	changes, err := manager.ReconcileMig(config, *migDryRun, func(index int) bool {
+		_, ok := inUse[index]
+		return ok
+	})
+	for _, change := range changes {
+		log.Printf("MIG reconfiguration (dry run: %v): %v", *migDryRun, change)
+	}
+	return err
+}
+
+func start(manager device.Manager, renames map[string]string, ledger *device.Ledger, policy device.Policy) error {
 	log.Println("Starting FS watcher.")
 	watcher, err := newFSWatcher(pluginapi.DevicePluginPath)
 	if err != nil {
@@ -71,9 +250,21 @@ restart:
 		p.Stop()
 	}
 
-	plugins = []plugin.DevicePlugin{
-		plugin.NewMonopolyDevicePlugin(pluginapi.DevicePluginPath, manager),
-		plugin.NewMemoryDevicePlugin(pluginapi.DevicePluginPath, manager),
+	if *resourcePerModel {
+		var err error
+		plugins, err = plugin.NewModelDevicePlugins(pluginapi.DevicePluginPath, manager, renames, ledger, policy, *visibleDevicesStrategy)
+		if err != nil {
+			return err
+		}
+	} else {
+		plugins = []plugin.DevicePlugin{
+			plugin.NewMonopolyDevicePlugin(pluginapi.DevicePluginPath, manager, ledger, *visibleDevicesStrategy),
+			plugin.NewMemoryDevicePlugin(pluginapi.DevicePluginPath, manager, ledger, policy, *visibleDevicesStrategy),
+			plugin.NewCoreDevicePlugin(pluginapi.DevicePluginPath, manager, ledger, policy, *visibleDevicesStrategy),
+		}
+	}
+	for _, profile := range manager.GetMigProfiles() {
+		plugins = append(plugins, plugin.NewMigDevicePlugin(pluginapi.DevicePluginPath, profile, manager, *visibleDevicesStrategy))
 	}
 
 	// Loop through all plugins, starting them if they have any devices
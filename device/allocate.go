@@ -0,0 +1,157 @@
+/*
+ * Copyright 2022 lbf1353@live.com
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package device
+
+import (
+	"fmt"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+	"sort"
+)
+
+// memorySlot describes the memory or core devices of one GPU as seen by an
+// allocation request.
+type memorySlot struct {
+	index     int
+	total     int
+	available []string
+	mustHave  []string
+}
+
+func (s *memorySlot) usage() GPUUsage {
+	return GPUUsage{
+		Index: s.index,
+		Total: s.total,
+		Free:  len(s.available) + len(s.mustHave),
+	}
+}
+
+// PreferredMemoryDevs picks size memory devices out of available so that they
+// all land on a single GPU, the GPU being chosen by policy unless the GPU at
+// index prefer, if not negative, can serve the request. Devices in mustInclude
+// are always part of the result. An empty result is returned when no single
+// GPU can satisfy the request.
+func PreferredMemoryDevs(m Manager, policy Policy, available, mustInclude []string, size int, prefer int) ([]string, error) {
+	return preferredSliceDevs(m, m.GetMemoryDevsOf, m.ParseMemoryDevID, policy, available, mustInclude, size, prefer)
+}
+
+// PreferredCoreDevs is like PreferredMemoryDevs for core devices.
+func PreferredCoreDevs(m Manager, policy Policy, available, mustInclude []string, size int, prefer int) ([]string, error) {
+	return preferredSliceDevs(m, m.GetCoreDevsOf, m.ParseCoreDevID, policy, available, mustInclude, size, prefer)
+}
+
+func preferredSliceDevs(m Manager, devsOf func(int) []*pluginapi.Device, parse parseFunc, policy Policy, available, mustInclude []string, size int, prefer int) ([]string, error) {
+	slots, err := groupSliceDevs(m, devsOf, parse, available, mustInclude)
+	if err != nil {
+		return nil, err
+	}
+
+	var candidates []*memorySlot
+	for _, s := range slots {
+		if len(s.mustHave) != len(mustInclude) {
+			continue
+		}
+		if len(s.available)+len(s.mustHave) < size {
+			continue
+		}
+		if s.index == prefer {
+			return s.pick(size), nil
+		}
+		candidates = append(candidates, s)
+	}
+	if len(candidates) == 0 {
+		return nil, nil
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return policy.Less(candidates[i].usage(), candidates[j].usage())
+	})
+
+	return candidates[0].pick(size), nil
+}
+
+// pick returns the must-include devices of the slot topped up with available
+// devices in slice order.
+func (s *memorySlot) pick(size int) []string {
+	devs := append([]string{}, s.mustHave...)
+	for _, id := range s.available {
+		if len(devs) >= size {
+			break
+		}
+		devs = append(devs, id)
+	}
+	return devs
+}
+
+// parseFunc returns the index of the owning GPU and the number of a memory or
+// core device ID.
+type parseFunc func(id string) (int, int, error)
+
+// groupSliceDevs groups the available and must-include devices by the GPU of
+// m they belong to, devsOf returning the devices of a GPU.
+func groupSliceDevs(m Manager, devsOf func(int) []*pluginapi.Device, parse parseFunc, available, mustInclude []string) ([]*memorySlot, error) {
+	slots := make(map[int]*memorySlot)
+	var order []int
+	for _, gpu := range m.GetGPUs() {
+		if total := len(devsOf(gpu.Index)); total != 0 {
+			slots[gpu.Index] = &memorySlot{index: gpu.Index, total: total}
+			order = append(order, gpu.Index)
+		}
+	}
+
+	// slice numbers of the available devices, to sort them without parsing
+	// their IDs again.
+	numbers := make(map[string]int)
+	must := make(map[string]struct{})
+	for _, id := range mustInclude {
+		idx, _, err := parse(id)
+		if err != nil {
+			return nil, err
+		}
+		s, ok := slots[idx]
+		if !ok {
+			return nil, fmt.Errorf("unknown device: %s", id)
+		}
+		s.mustHave = append(s.mustHave, id)
+		must[id] = struct{}{}
+	}
+
+	for _, id := range available {
+		if _, ok := must[id]; ok {
+			continue
+		}
+		idx, num, err := parse(id)
+		if err != nil {
+			return nil, err
+		}
+		s, ok := slots[idx]
+		if !ok {
+			return nil, fmt.Errorf("unknown device: %s", id)
+		}
+		s.available = append(s.available, id)
+		numbers[id] = num
+	}
+
+	var res []*memorySlot
+	for _, idx := range order {
+		s := slots[idx]
+		sort.Slice(s.available, func(i, j int) bool {
+			return numbers[s.available[i]] < numbers[s.available[j]]
+		})
+		res = append(res, s)
+	}
+	return res, nil
+}
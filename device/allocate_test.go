@@ -0,0 +1,92 @@
+/*
+ * Copyright 2022 lbf1353@live.com
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package device
+
+import (
+	"fmt"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+	"testing"
+)
+
+// ids returns the IDs of devs.
+func ids(devs []*pluginapi.Device) []string {
+	var ids []string
+	for _, dev := range devs {
+		ids = append(ids, dev.ID)
+	}
+	return ids
+}
+
+func BenchmarkPreferredMemoryDevs(b *testing.B) {
+	m := newBenchManager(b)
+	available := ids(m.GetMemoryDevs())
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		devs, err := PreferredMemoryDevs(m, BinpackPolicy{}, available, nil, 1024, -1)
+		if err != nil || len(devs) != 1024 {
+			b.Fatalf("PreferredMemoryDevs = %d devices, %v", len(devs), err)
+		}
+	}
+}
+
+func TestPreferredMemoryDevs(t *testing.T) {
+	opts := testOptions()
+	opts.MemoryUnit = GiB
+	m := newTestManager(t, "4Gi,4Gi,4Gi", opts)
+	// half of gpu 1 is allocated
+	available := []string{
+		"MEM-0-0", "MEM-0-1", "MEM-0-2", "MEM-0-3",
+		"MEM-1-2", "MEM-1-3",
+		"MEM-2-0", "MEM-2-1", "MEM-2-2", "MEM-2-3",
+	}
+
+	tests := []struct {
+		name        string
+		policy      Policy
+		mustInclude []string
+		size        int
+		prefer      int
+		want        []string
+	}{
+		{"binpack", BinpackPolicy{}, nil, 2, -1, []string{"MEM-1-2", "MEM-1-3"}},
+		{"spread", SpreadPolicy{}, nil, 2, -1, []string{"MEM-0-0", "MEM-0-1"}},
+		{"binpack too large for the most used gpu", BinpackPolicy{}, nil, 3, -1, []string{"MEM-0-0", "MEM-0-1", "MEM-0-2"}},
+		{"must include", BinpackPolicy{}, []string{"MEM-2-3"}, 2, -1, []string{"MEM-2-3", "MEM-2-0"}},
+		{"must include only", SpreadPolicy{}, []string{"MEM-1-3", "MEM-1-2"}, 2, -1, []string{"MEM-1-3", "MEM-1-2"}},
+		{"must include too small", BinpackPolicy{}, []string{"MEM-1-2"}, 3, -1, nil},
+		{"must include across gpus", BinpackPolicy{}, []string{"MEM-0-0", "MEM-2-0"}, 2, -1, nil},
+		{"too large", BinpackPolicy{}, nil, 5, -1, nil},
+		{"preferred", BinpackPolicy{}, nil, 2, 2, []string{"MEM-2-0", "MEM-2-1"}},
+		{"preferred too small", BinpackPolicy{}, nil, 3, 1, []string{"MEM-0-0", "MEM-0-1", "MEM-0-2"}},
+		{"preferred without must include", BinpackPolicy{}, []string{"MEM-0-3"}, 1, 2, []string{"MEM-0-3"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := PreferredMemoryDevs(m, tt.policy, available, tt.mustInclude, tt.size, tt.prefer)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	if _, err := PreferredMemoryDevs(m, BinpackPolicy{}, available, []string{"MEM-7-0"}, 1, -1); err == nil {
+		t.Errorf("PreferredMemoryDevs of an unknown device succeeded, want error")
+	}
+}
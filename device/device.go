@@ -17,114 +17,820 @@
 package device
 
 import (
+	"errors"
 	"fmt"
 	"github.com/NVIDIA/go-nvml/pkg/nvml"
 	"k8s.io/klog/v2"
 	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 )
 
 const (
-	MiB = 1
-	GiB = 1024 * MiB
+	GPUDevPrefix    = "GPU"
+	MemoryDevPrefix = "MEM"
+	CoreDevPrefix   = "CORE"
 )
 
+// CoresPerGPU is the number of core devices of a GPU, each a percent of its
+// streaming multiprocessors.
+const CoresPerGPU = 100
+
+const (
+	// DeviceIDIndex refers to GPUs by index in device IDs.
+	DeviceIDIndex = "index"
+	// DeviceIDUUID refers to GPUs by UUID in device IDs, which keeps them
+	// stable across reboots and GPU reordering.
+	DeviceIDUUID = "uuid"
+)
+
+const (
+	// ModeAll offers a GPU both exclusively and as memory devices.
+	ModeAll = "all"
+	// ModeExclusive offers a GPU only exclusively.
+	ModeExclusive = "exclusive"
+	// ModeShared offers a GPU only as memory and core devices.
+	ModeShared = "shared"
+)
+
+// DefaultMemoryUnit is the default size of a memory slice.
+const DefaultMemoryUnit = GiB
+
+// Options configures a GPUManager.
+type Options struct {
+	// DeviceIDStrategy is how GPUs are referred to in device IDs, one of
+	// DeviceIDIndex or DeviceIDUUID.
+	DeviceIDStrategy string
+	// MemoryUnit is the size of a memory slice, a multiple of MiB. The
+	// remainder of the GPU memory which does not fill a whole slice is not
+	// advertised.
+	MemoryUnit Quantity
+	// ReservedMemory is the memory of every GPU kept out of the memory
+	// slices for the CUDA contexts and the driver.
+	ReservedMemory Reservation
+	// ReservedMemoryByModel overrides ReservedMemory for the GPUs whose
+	// product name is a key of the map.
+	ReservedMemoryByModel map[string]Reservation
+	// OvercommitRatio multiplies the memory of every GPU advertised as memory
+	// devices, 1 advertises the physical memory.
+	OvercommitRatio float64
+	// OvercommitLimit caps the memory advertised for a GPU when
+	// overcommitted, 0 for no cap. The physical memory is always advertised.
+	OvercommitLimit Quantity
+	// MaxMemoryDevs caps the number of memory devices of the node, 0 for no
+	// cap. MemoryUnit is doubled until the memory devices fit.
+	MaxMemoryDevs int
+	// Filter selects the GPUs of the node which are advertised at all.
+	Filter Filter
+	// ExclusiveGPUs selects the GPUs offered only exclusively.
+	ExclusiveGPUs Selector
+	// SharedGPUs selects the GPUs offered only as memory and core devices.
+	SharedGPUs Selector
+}
+
+// Validate checks that all options have valid values.
+func (o Options) Validate() error {
+	switch o.DeviceIDStrategy {
+	case DeviceIDIndex, DeviceIDUUID:
+	default:
+		return fmt.Errorf("unknown device id strategy: %s", o.DeviceIDStrategy)
+	}
+	if o.MemoryUnit == 0 || o.MemoryUnit%MiB != 0 {
+		return fmt.Errorf("memory unit must be a positive multiple of 1Mi, got %v", o.MemoryUnit)
+	}
+	if o.MaxMemoryDevs < 0 {
+		return fmt.Errorf("max memory devices must not be negative, got %d", o.MaxMemoryDevs)
+	}
+	if math.IsNaN(o.OvercommitRatio) || math.IsInf(o.OvercommitRatio, 0) || o.OvercommitRatio < 1 {
+		return fmt.Errorf("overcommit ratio must be a finite number of at least 1, got %v", o.OvercommitRatio)
+	}
+	if err := o.ReservedMemory.Validate(); err != nil {
+		return err
+	}
+	for model, r := range o.ReservedMemoryByModel {
+		if err := r.Validate(); err != nil {
+			return fmt.Errorf("%s: %v", model, err)
+		}
+	}
+	return nil
+}
+
+// mode returns how gpu is offered, an ErrInvalidConfig error if it is
+// selected both as exclusive and as shared.
+func (o Options) mode(gpu GPUInfo) (string, error) {
+	exclusive, shared := o.ExclusiveGPUs.Matches(gpu), o.SharedGPUs.Matches(gpu)
+	switch {
+	case exclusive && shared:
+		return "", fmt.Errorf("%w: gpu %d is selected both as exclusive and as shared", ErrInvalidConfig, gpu.Index)
+	case exclusive:
+		return ModeExclusive, nil
+	case shared:
+		return ModeShared, nil
+	}
+	return ModeAll, nil
+}
+
+// overcommit returns the memory advertised as memory devices for a GPU with
+// usable memory once overcommitted, and the effective overcommit ratio which
+// is below OvercommitRatio if OvercommitLimit caps the memory.
+func (o Options) overcommit(usable Quantity) (Quantity, float64) {
+	mem := Quantity(float64(usable) * o.OvercommitRatio)
+	if o.OvercommitLimit == 0 || mem <= o.OvercommitLimit {
+		return mem, o.OvercommitRatio
+	}
+	if usable == 0 || o.OvercommitLimit <= usable {
+		return usable, 1
+	}
+	return o.OvercommitLimit, float64(o.OvercommitLimit) / float64(usable)
+}
+
+// reservation returns the reserved memory of the GPUs of model.
+func (o Options) reservation(model string) Reservation {
+	if r, ok := o.ReservedMemoryByModel[model]; ok {
+		return r
+	}
+	return o.ReservedMemory
+}
+
+// ParseMemoryUnit parses a memory slice size such as "256Mi" or "1Gi".
+func ParseMemoryUnit(str string) (Quantity, error) {
+	unit, err := ParseQuantity(str)
+	if err != nil {
+		return 0, err
+	}
+	if unit == 0 || unit%MiB != 0 {
+		return 0, fmt.Errorf("invalid memory unit %q: must be a positive multiple of 1Mi", str)
+	}
+	return unit, nil
+}
+
+// ErrNoDriver is returned when the NVIDIA driver or the NVML library is
+// missing on the node.
+var ErrNoDriver = errors.New("nvidia driver not found")
+
+// ErrInvalidConfig is returned when the options do not fit the GPUs of the
+// node, which retrying discovery does not fix.
+var ErrInvalidConfig = errors.New("invalid configuration")
+
 type Manager interface {
+	// GetMemoryDevs returns the memory devices, grouped by GPU in index order.
+	// The result is shared and must not be modified.
 	GetMemoryDevs() []*pluginapi.Device
+	// GetMemoryDevsOf returns the memory devices of the GPU at index. The
+	// result is shared and must not be modified.
+	GetMemoryDevsOf(index int) []*pluginapi.Device
+	// GetGPUDevs returns the exclusive devices. The result is shared and
+	// must not be modified.
 	GetGPUDevs() []*pluginapi.Device
+	// IsMemoryDev reports whether id refers to one of the memory devices, in
+	// either device ID format.
+	IsMemoryDev(id string) bool
+	// GetCoreDevs returns the core devices, grouped by GPU in index order.
+	// The result is shared and must not be modified.
+	GetCoreDevs() []*pluginapi.Device
+	// GetCoreDevsOf returns the core devices of the GPU at index. The result
+	// is shared and must not be modified.
+	GetCoreDevsOf(index int) []*pluginapi.Device
+	// IsCoreDev reports whether id refers to one of the core devices, in
+	// either device ID format.
+	IsCoreDev(id string) bool
+	// ParseCoreDevID returns the index of the owning GPU and the percent
+	// number of a core device ID.
+	ParseCoreDevID(id string) (int, int, error)
+	// GetMigProfiles returns the profiles of the MIG devices, sorted.
+	GetMigProfiles() []string
+	// GetMigDevs returns the MIG devices of profile. The result is shared and
+	// must not be modified.
+	GetMigDevs(profile string) []*pluginapi.Device
+	// ParseMigDevID returns the MIG device of a MIG device ID.
+	ParseMigDevID(id string) (MigInfo, error)
+	// GetGPUs returns the metadata of all GPUs, in index order.
+	GetGPUs() []GPUInfo
+	// GetGPU returns the metadata of the GPU at index.
+	GetGPU(index int) (GPUInfo, error)
+	// GetMemoryUnit returns the size of a memory device.
+	GetMemoryUnit() Quantity
+	// ParseGPUDevID returns the index of the GPU of an exclusive device ID.
+	ParseGPUDevID(id string) (int, error)
+	// ParseMemoryDevID returns the index of the owning GPU and the slice
+	// number of a memory device ID.
+	ParseMemoryDevID(id string) (int, int, error)
+	// SetHealth sets the health of the GPU at index and all its memory devices.
+	SetHealth(index int, health string)
+	// Subscribe returns a channel signaled whenever the device lists change,
+	// and a function to cancel the subscription.
+	Subscribe() (<-chan struct{}, func())
+	// Close releases the resources held by the manager.
+	Close() error
+}
+
+// GPUInfo is the metadata of a GPU captured at discovery.
+type GPUInfo struct {
+	Index int
+	UUID  string
+	// Name is the product name, e.g. "Tesla T4".
+	Name string
+	// Minor is the minor number of the /dev/nvidia<minor> device node, -1 for
+	// mock GPUs which have none.
+	Minor int
+	// Memory is the total memory.
+	Memory Quantity
+	// Reserved is the part of Memory which is not shared out as memory
+	// devices.
+	Reserved Quantity
+	// Advertised is the memory shared out as memory devices, the memory left
+	// once Reserved is subtracted multiplied by OvercommitRatio.
+	Advertised Quantity
+	// OvercommitRatio is how many times the memory left once Reserved is
+	// subtracted is advertised, 1 if the GPU is not overcommitted.
+	OvercommitRatio float64
+	PciBusID        string
+	// NumaNode is -1 if unknown.
+	NumaNode int
+	// ComputeCapability is the CUDA compute capability, e.g. "7.5".
+	ComputeCapability string
+	DriverVersion     string
+	// CudaVersion is the CUDA version supported by the driver, e.g. "11.4".
+	CudaVersion string
+	// MigEnabled GPUs are only offered as their MigDevices.
+	MigEnabled bool
+	MigDevices []MigInfo
+	// Mode is how the GPU is offered, one of ModeAll, ModeExclusive or
+	// ModeShared.
+	Mode string
 }
 
 type GPU struct {
-	index  int
-	memory uint64
+	info   GPUInfo
+	health string
+	// slices is the number of memory devices of the GPU.
+	slices int
+	// memoryDevs and coreDevs are the devices of the GPU within the device
+	// lists of the manager.
+	memoryDevs []*pluginapi.Device
+	coreDevs   []*pluginapi.Device
 }
 
+// shareable reports whether the GPU is offered as memory and core devices.
+func (gpu *GPU) shareable() bool {
+	return gpu.info.Mode != ModeExclusive && !gpu.info.MigEnabled
+}
+
+// GPUManager discovers the GPUs of the node through NVML.
 type GPUManager struct {
+	Notifier
+
+	opts Options
+	lib  NVML
+
+	mu sync.RWMutex
+	// unit is the size of a memory device, MemoryUnit coarsened to fit
+	// MaxMemoryDevs.
+	unit Quantity
 	gpus []*GPU
+	// memoryDevs and gpuDevs are rebuilt whenever the health of a GPU
+	// changes, and handed out as is.
+	memoryDevs []*pluginapi.Device
+	coreDevs   []*pluginapi.Device
+	gpuDevs    []*pluginapi.Device
+	migDevs    map[string][]*pluginapi.Device
 }
 
 var _ Manager = &GPUManager{}
 
-func NewGPUManager() *GPUManager {
-	initNVML()
+// NewGPUManager initializes NVML and discovers the GPUs of the node. NVML is
+// left initialized on success and must be shut down with Close.
+func NewGPUManager(opts Options) (*GPUManager, error) {
+	return NewGPUManagerWithNVML(NewNVML(), opts)
+}
+
+// NewGPUManagerWithNVML is like NewGPUManager, with GPUs discovered through lib.
+func NewGPUManagerWithNVML(lib NVML, opts Options) (*GPUManager, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+	if err := lib.Init(); err != nil {
+		return nil, err
+	}
+
+	m := &GPUManager{
+		opts: opts,
+		lib:  lib,
+	}
+	if err := m.discover(); err != nil {
+		lib.Shutdown()
+		return nil, err
+	}
+	return m, nil
+}
+
+// discover discovers the GPUs through NVML, keeps the ones allowed by the
+// options and builds the device lists.
+func (m *GPUManager) discover() error {
+	gpus, err := discoverGPUs(m.lib)
+	if err != nil {
+		return err
+	}
+	var allowed []*GPU
+	for _, gpu := range gpus {
+		if !m.opts.Filter.Allows(gpu.info) {
+			klog.InfoS("gpu filtered out", "index", gpu.info.Index, "uuid", gpu.info.UUID, "name", gpu.info.Name)
+			continue
+		}
+		if gpu.info.Mode, err = m.opts.mode(gpu.info); err != nil {
+			return err
+		}
+		gpu.info.Reserved = m.opts.reservation(gpu.info.Name).Of(gpu.info.Memory)
+		gpu.info.Advertised, gpu.info.OvercommitRatio = m.opts.overcommit(gpu.info.Memory - gpu.info.Reserved)
+		allowed = append(allowed, gpu)
+	}
+
+	unit := m.sliceMemory(allowed)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// GPUs found again keep their health, an XID error is not cleared by
+	// rediscovery.
+	for _, gpu := range allowed {
+		for _, old := range m.gpus {
+			if old.info.UUID == gpu.info.UUID {
+				gpu.health = old.health
+			}
+		}
+	}
+	m.gpus = allowed
+	m.unit = unit
+	m.buildDevs()
+	return nil
+}
+
+// ReconcileMig repartitions the GPUs for which inUse returns false into the
+// MIG devices declared by config, and rediscovers the GPUs if any changed.
+// The device plugins must be registered again for new MIG profiles.
+func (m *GPUManager) ReconcileMig(config MigConfig, dryRun bool, inUse func(index int) bool) ([]MigChange, error) {
+	changes, err := NewMigReconciler(m.lib, config, dryRun).Reconcile(m.GetGPUs(), inUse)
+	if len(changes) != 0 && !dryRun {
+		if derr := m.discover(); derr != nil && err == nil {
+			err = derr
+		}
+		m.Notify()
+	}
+	return changes, err
+}
+
+// sliceMemory sets the number of memory devices of every GPU of gpus,
+// doubling the memory unit until they fit MaxMemoryDevs, and returns the unit.
+func (m *GPUManager) sliceMemory(gpus []*GPU) Quantity {
+	unit := m.opts.MemoryUnit
+	for {
+		total := 0
+		for _, gpu := range gpus {
+			gpu.slices = 0
+			if gpu.shareable() {
+				gpu.slices = int(gpu.info.Advertised / unit)
+			}
+			total += gpu.slices
+		}
+		if m.opts.MaxMemoryDevs == 0 || total <= m.opts.MaxMemoryDevs {
+			break
+		}
+		unit *= 2
+	}
+	if unit != m.opts.MemoryUnit {
+		klog.InfoS("memory unit coarsened to fit max memory devices", "unit", unit, "configured", m.opts.MemoryUnit, "max", m.opts.MaxMemoryDevs)
+	}
+	return unit
+}
+
+// buildDevs rebuilds the device lists from the GPUs. m.mu must be held for
+// writing.
+func (m *GPUManager) buildDevs() {
+	total := 0
+	for _, gpu := range m.gpus {
+		total += gpu.slices
+	}
+
+	memoryDevs := make([]*pluginapi.Device, 0, total)
+	var coreDevs []*pluginapi.Device
+	var gpuDevs []*pluginapi.Device
+	migDevs := make(map[string][]*pluginapi.Device)
+	for _, gpu := range m.gpus {
+		start := len(memoryDevs)
+		for j := 0; j < gpu.slices; j++ {
+			memoryDevs = append(memoryDevs, &pluginapi.Device{
+				ID:     m.memoryDevID(gpu, j),
+				Health: gpu.health,
+			})
+		}
+		gpu.memoryDevs = memoryDevs[start:len(memoryDevs):len(memoryDevs)]
+
+		start = len(coreDevs)
+		if gpu.shareable() {
+			for j := 0; j < CoresPerGPU; j++ {
+				coreDevs = append(coreDevs, &pluginapi.Device{
+					ID:     m.coreDevID(gpu, j),
+					Health: gpu.health,
+				})
+			}
+		}
+		gpu.coreDevs = coreDevs[start:len(coreDevs):len(coreDevs)]
+		for _, mig := range gpu.info.MigDevices {
+			migDevs[mig.Profile] = append(migDevs[mig.Profile], &pluginapi.Device{
+				ID:     mig.UUID,
+				Health: gpu.health,
+			})
+		}
+		if gpu.info.Mode != ModeShared && !gpu.info.MigEnabled {
+			gpuDevs = append(gpuDevs, &pluginapi.Device{
+				ID:     m.gpuDevID(gpu),
+				Health: gpu.health,
+			})
+		}
+	}
+
+	klog.V(6).InfoS("built device lists", "memory", len(memoryDevs), "core", len(coreDevs), "gpu", len(gpuDevs), "unit", m.unit)
+	m.memoryDevs = memoryDevs
+	m.coreDevs = coreDevs
+	m.gpuDevs = gpuDevs
+	m.migDevs = migDevs
+}
+
+func discoverGPUs(lib NVML) ([]*GPU, error) {
+	driver, err := lib.DriverVersion()
+	if err != nil {
+		return nil, err
+	}
+	cuda, err := lib.CudaDriverVersion()
+	if err != nil {
+		return nil, err
+	}
+
 	var gpus []*GPU
-	cnt := getDeviceCount()
+	cnt, err := lib.DeviceCount()
+	if err != nil {
+		return nil, err
+	}
 	for i := 0; i < cnt; i++ {
-		mem := getDeviceMemory(i)
-		gpu := GPU{
-			index:  i,
-			memory: mem,
+		dev, err := lib.DeviceByIndex(i)
+		if err != nil {
+			return nil, err
+		}
+		info, err := getGPUInfo(dev)
+		if err != nil {
+			return nil, err
+		}
+		info.Index = i
+		if info.MigEnabled {
+			if info.MigDevices, err = getMigDevices(dev, i); err != nil {
+				return nil, err
+			}
 		}
-		gpus = append(gpus, &gpu)
+		info.DriverVersion = driver
+		info.CudaVersion = fmt.Sprintf("%d.%d", cuda/1000, cuda%1000/10)
+
+		klog.V(6).InfoS("discovered gpu", "index", i, "uuid", info.UUID, "name", info.Name, "memory", info.Memory)
+		gpus = append(gpus, &GPU{
+			info:   info,
+			health: pluginapi.Healthy,
+		})
 	}
+	return gpus, nil
+}
 
-	return &GPUManager{
-		gpus: gpus,
+// getGPUInfo returns the metadata reported by dev itself.
+func getGPUInfo(dev NVMLDevice) (GPUInfo, error) {
+	var info GPUInfo
+	var err error
+	if info.UUID, err = dev.UUID(); err != nil {
+		return info, err
+	}
+	if info.Name, err = dev.Name(); err != nil {
+		return info, err
+	}
+	if info.Minor, err = dev.MinorNumber(); err != nil {
+		return info, err
+	}
+	mem, err := dev.MemoryTotal()
+	if err != nil {
+		return info, err
 	}
+	info.Memory = Quantity(mem)
+	if info.PciBusID, err = dev.PciBusID(); err != nil {
+		return info, err
+	}
+	if info.NumaNode, err = dev.NumaNode(); err != nil {
+		return info, err
+	}
+	major, minor, err := dev.CudaComputeCapability()
+	if err != nil {
+		return info, err
+	}
+	info.ComputeCapability = fmt.Sprintf("%d.%d", major, minor)
+	mig, _, err := dev.MigMode()
+	if err != nil {
+		return info, err
+	}
+	info.MigEnabled = mig == nvml.DEVICE_MIG_ENABLE
+	return info, nil
+}
+
+// NewEventSource returns an EventSource for the critical XID events of the GPUs.
+func (m *GPUManager) NewEventSource() (EventSource, error) {
+	return newEventSource(m.lib)
+}
+
+// Close shuts NVML down, NVML must not be used afterwards.
+func (m *GPUManager) Close() error {
+	return m.lib.Shutdown()
 }
 
 func (m *GPUManager) GetMemoryDevs() []*pluginapi.Device {
-	var devs []*pluginapi.Device
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return m.memoryDevs
+}
+
+func (m *GPUManager) GetMemoryDevsOf(index int) []*pluginapi.Device {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	for _, gpu := range m.gpus {
+		if gpu.info.Index == index {
+			return gpu.memoryDevs
+		}
+	}
+	return nil
+}
+
+func (m *GPUManager) GetGPUDevs() []*pluginapi.Device {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return m.gpuDevs
+}
+
+func (m *GPUManager) IsMemoryDev(id string) bool {
+	index, slice, err := m.ParseMemoryDevID(id)
+	if err != nil {
+		return false
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	for _, gpu := range m.gpus {
+		if gpu.info.Index == index {
+			return slice < gpu.slices
+		}
+	}
+	return false
+}
+
+func (m *GPUManager) GetCoreDevs() []*pluginapi.Device {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return m.coreDevs
+}
+
+func (m *GPUManager) GetCoreDevsOf(index int) []*pluginapi.Device {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	for _, gpu := range m.gpus {
+		if gpu.info.Index == index {
+			return gpu.coreDevs
+		}
+	}
+	return nil
+}
+
+func (m *GPUManager) IsCoreDev(id string) bool {
+	index, percent, err := m.ParseCoreDevID(id)
+	if err != nil {
+		return false
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	for _, gpu := range m.gpus {
+		if gpu.info.Index == index {
+			return gpu.shareable() && percent < CoresPerGPU
+		}
+	}
+	return false
+}
+
+func (m *GPUManager) GetMigProfiles() []string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var profiles []string
+	for profile := range m.migDevs {
+		profiles = append(profiles, profile)
+	}
+	sort.Strings(profiles)
+	return profiles
+}
+
+func (m *GPUManager) GetMigDevs(profile string) []*pluginapi.Device {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return m.migDevs[profile]
+}
+
+// ParseMigDevID returns the MIG device of a MIG device ID, the UUID of the
+// MIG device whatever the DeviceIDStrategy.
+func (m *GPUManager) ParseMigDevID(id string) (MigInfo, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
 	for _, gpu := range m.gpus {
-		// minimum unit GiB
-		sz := gpu.memory / GiB
-
-		klog.V(6).InfoS("device memory size", "index", gpu.index, "size", sz)
-		for j := uint64(0); j < sz; j++ {
-			dev := pluginapi.Device{
-				ID:     fmt.Sprintf("MEM-%d-%d", gpu.index, j),
-				Health: pluginapi.Healthy,
+		for _, mig := range gpu.info.MigDevices {
+			if mig.UUID == id {
+				return mig, nil
 			}
-			devs = append(devs, &dev)
 		}
 	}
+	return MigInfo{}, fmt.Errorf("unknown mig device: %s", id)
+}
 
-	klog.V(6).InfoS("total device memory size", "size", len(devs))
-	return devs
+func (m *GPUManager) GetMemoryUnit() Quantity {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.unit
 }
 
-func (m *GPUManager) GetGPUDevs() []*pluginapi.Device {
-	var devs []*pluginapi.Device
+func (m *GPUManager) GetGPUs() []GPUInfo {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var infos []GPUInfo
+	for _, gpu := range m.gpus {
+		infos = append(infos, gpu.info)
+	}
+	return infos
+}
+
+func (m *GPUManager) GetGPU(index int) (GPUInfo, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
 	for _, gpu := range m.gpus {
-		dev := pluginapi.Device{
-			ID:     fmt.Sprintf("GPU-%d", gpu.index),
-			Health: pluginapi.Healthy,
+		if gpu.info.Index == index {
+			return gpu.info, nil
 		}
-		devs = append(devs, &dev)
 	}
-	return devs
+	return GPUInfo{}, fmt.Errorf("unknown gpu index: %d", index)
 }
 
-func initNVML() {
-	ret := nvml.Init()
-	if ret != nvml.SUCCESS {
-		klog.Fatalf("Unable to initialize NVML: %v", nvml.ErrorString(ret))
+func (m *GPUManager) SetHealth(index int, health string) {
+	m.mu.Lock()
+	changed := false
+	for _, gpu := range m.gpus {
+		if gpu.info.Index == index && gpu.health != health {
+			gpu.health = health
+			changed = true
+		}
+	}
+	if changed {
+		m.buildDevs()
+	}
+	m.mu.Unlock()
+
+	if changed {
+		klog.InfoS("gpu health changed", "index", index, "health", health)
+		m.Notify()
+	}
+}
+
+// gpuRef returns how gpu is referred to in its device IDs.
+func (m *GPUManager) gpuRef(gpu *GPU) string {
+	if m.opts.DeviceIDStrategy == DeviceIDUUID {
+		return gpu.info.UUID
+	}
+	return strconv.Itoa(gpu.info.Index)
+}
+
+// gpuDevID returns the ID of the exclusive device of gpu, GPU-<index> or the
+// UUID of the GPU, which reads GPU-<uuid>.
+func (m *GPUManager) gpuDevID(gpu *GPU) string {
+	if m.opts.DeviceIDStrategy == DeviceIDUUID {
+		return gpu.info.UUID
 	}
-	defer func() {
-		ret := nvml.Shutdown()
-		if ret != nvml.SUCCESS {
-			klog.Fatalf("Unable to shutdown NVML: %v", nvml.ErrorString(ret))
+	return fmt.Sprintf("%s-%d", GPUDevPrefix, gpu.info.Index)
+}
+
+// memoryDevID returns the ID of the j-th memory slice of gpu,
+// MEM-<index>-<j> or MEM-<uuid>-<j>.
+func (m *GPUManager) memoryDevID(gpu *GPU, j int) string {
+	return fmt.Sprintf("%s-%s-%d", MemoryDevPrefix, m.gpuRef(gpu), j)
+}
+
+// coreDevID returns the ID of the j-th core device of gpu, CORE-<index>-<j>
+// or CORE-<uuid>-<j>.
+func (m *GPUManager) coreDevID(gpu *GPU, j int) string {
+	return fmt.Sprintf("%s-%s-%d", CoreDevPrefix, m.gpuRef(gpu), j)
+}
+
+// resolveGPU returns the index of the GPU referred to by its index or UUID.
+func (m *GPUManager) resolveGPU(ref string) (int, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	index, err := strconv.Atoi(ref)
+	for _, gpu := range m.gpus {
+		if (err == nil && gpu.info.Index == index) || gpu.info.UUID == ref {
+			return gpu.info.Index, nil
 		}
-	}()
+	}
+	return 0, fmt.Errorf("unknown gpu: %s", ref)
 }
 
-func getDeviceCount() int {
-	count, ret := nvml.DeviceGetCount()
-	if ret != nvml.SUCCESS {
-		klog.Fatalf("Unable to get device count: %v", nvml.ErrorString(ret))
+// ParseGPUDevID returns the index of the GPU of an exclusive device ID. Both
+// index and UUID based IDs are accepted, whatever the DeviceIDStrategy.
+func (m *GPUManager) ParseGPUDevID(id string) (int, error) {
+	ref := strings.TrimPrefix(id, GPUDevPrefix+"-")
+	if ref == id {
+		return 0, fmt.Errorf("malformed gpu device id: %s", id)
+	}
+	if _, err := strconv.Atoi(ref); err != nil {
+		// UUIDs keep their GPU- prefix.
+		ref = id
 	}
-	return count
+	return m.resolveGPU(ref)
+}
+
+// ParseMemoryDevID returns the index of the owning GPU and the slice number of
+// a memory device ID. Both index and UUID based IDs are accepted, whatever the
+// DeviceIDStrategy.
+func (m *GPUManager) ParseMemoryDevID(id string) (int, int, error) {
+	return m.parseSliceDevID(MemoryDevPrefix, "memory", id)
+}
+
+// ParseCoreDevID returns the index of the owning GPU and the percent number of
+// a core device ID. Both index and UUID based IDs are accepted, whatever the
+// DeviceIDStrategy.
+func (m *GPUManager) ParseCoreDevID(id string) (int, int, error) {
+	return m.parseSliceDevID(CoreDevPrefix, "core", id)
 }
 
-func getDeviceMemory(idx int) uint64 {
-	dev, ret := nvml.DeviceGetHandleByIndex(idx)
-	if ret != nvml.SUCCESS {
-		klog.Fatalf("Unable to get device by index %v: %v", idx, nvml.ErrorString(ret))
+// parseSliceDevID parses a <prefix>-<gpu>-<number> device ID of kind.
+func (m *GPUManager) parseSliceDevID(prefix, kind, id string) (int, int, error) {
+	rest := strings.TrimPrefix(id, prefix+"-")
+	sep := strings.LastIndex(rest, "-")
+	if rest == id || sep <= 0 {
+		return 0, 0, fmt.Errorf("malformed %s device id: %s", kind, id)
+	}
+	num, err := strconv.Atoi(rest[sep+1:])
+	if err != nil || num < 0 {
+		return 0, 0, fmt.Errorf("malformed number in %s device id: %s", kind, id)
+	}
+	index, err := m.resolveGPU(rest[:sep])
+	if err != nil {
+		return 0, 0, err
 	}
+	return index, num, nil
+}
+
+// ValidateMemoryAllocation checks that all ids are memory devices advertised by
+// m and that they belong to a single GPU, whose index is returned.
+func ValidateMemoryAllocation(m Manager, ids []string) (int, error) {
+	return validateSliceAllocation("memory", ids, m.IsMemoryDev, m.ParseMemoryDevID)
+}
 
-	mem, ret := dev.GetMemoryInfo()
-	if ret != nvml.SUCCESS {
-		klog.Fatalf("Unable to get device memory: %v", nvml.ErrorString(ret))
+// ValidateCoreAllocation checks that all ids are core devices advertised by m
+// and that they belong to a single GPU, whose index is returned.
+func ValidateCoreAllocation(m Manager, ids []string) (int, error) {
+	return validateSliceAllocation("core", ids, m.IsCoreDev, m.ParseCoreDevID)
+}
+
+func validateSliceAllocation(kind string, ids []string, known func(string) bool, parse func(string) (int, int, error)) (int, error) {
+	if len(ids) == 0 {
+		return 0, fmt.Errorf("no %s device requested", kind)
 	}
 
-	return mem.Total
+	index := -1
+	for _, id := range ids {
+		if !known(id) {
+			return 0, fmt.Errorf("unknown device: %s", id)
+		}
+		idx, _, err := parse(id)
+		if err != nil {
+			return 0, err
+		}
+		if index == -1 {
+			index = idx
+		} else if idx != index {
+			return 0, fmt.Errorf("%s devices span multiple gpus: %s is on gpu %d, expected gpu %d", kind, id, idx, index)
+		}
+	}
+	return index, nil
 }
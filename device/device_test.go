@@ -0,0 +1,414 @@
+/*
+ * Copyright 2022 lbf1353@live.com
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package device
+
+import (
+	"errors"
+	"fmt"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+	"math"
+	"testing"
+)
+
+// testOptions returns the default options of the command line.
+func testOptions() Options {
+	return Options{
+		DeviceIDStrategy: DeviceIDIndex,
+		MemoryUnit:       DefaultMemoryUnit,
+		OvercommitRatio:  1,
+	}
+}
+
+// newTestManager returns a mock manager of devs, failing t on error.
+func newTestManager(t testing.TB, devs string, opts Options) *GPUManager {
+	t.Helper()
+	m, err := NewMockManager(devs, opts)
+	if err != nil {
+		t.Fatalf("NewMockManager(%q): %v", devs, err)
+	}
+	t.Cleanup(func() { m.Close() })
+	return m
+}
+
+func TestDeviceIDFormats(t *testing.T) {
+	for _, strategy := range []string{DeviceIDIndex, DeviceIDUUID} {
+		t.Run(strategy, func(t *testing.T) {
+			opts := testOptions()
+			opts.DeviceIDStrategy = strategy
+			m := newTestManager(t, "2Gi,2Gi", opts)
+			uuid := "GPU-00000000-0000-0000-0000-000000000001"
+
+			for _, id := range []string{"GPU-1", uuid} {
+				idx, err := m.ParseGPUDevID(id)
+				if err != nil || idx != 1 {
+					t.Errorf("ParseGPUDevID(%q) = %d, %v, want 1", id, idx, err)
+				}
+			}
+			for _, id := range []string{"MEM-1-1", "MEM-" + uuid + "-1"} {
+				if !m.IsMemoryDev(id) {
+					t.Errorf("IsMemoryDev(%q) = false, want true", id)
+				}
+				idx, slice, err := m.ParseMemoryDevID(id)
+				if err != nil || idx != 1 || slice != 1 {
+					t.Errorf("ParseMemoryDevID(%q) = %d, %d, %v, want 1, 1", id, idx, slice, err)
+				}
+			}
+			for _, id := range []string{"CORE-1-99", "CORE-" + uuid + "-99"} {
+				if !m.IsCoreDev(id) {
+					t.Errorf("IsCoreDev(%q) = false, want true", id)
+				}
+			}
+			for _, id := range []string{"MEM-1-2", "MEM-2-0", "CORE-1-100", "GPU-1"} {
+				if m.IsMemoryDev(id) || m.IsCoreDev(id) {
+					t.Errorf("%q is reported as a memory or core device", id)
+				}
+			}
+		})
+	}
+}
+
+func TestOvercommit(t *testing.T) {
+	opts := testOptions()
+	opts.OvercommitRatio = 1.5
+	opts.OvercommitLimit = 48 * GiB
+	m := newTestManager(t, "16Gi,40Gi,64Gi", opts)
+
+	tests := []struct {
+		advertised Quantity
+		ratio      float64
+	}{
+		{24 * GiB, 1.5},
+		// capped
+		{48 * GiB, 1.2},
+		// capped below the physical memory
+		{64 * GiB, 1},
+	}
+	for i, tt := range tests {
+		gpu, err := m.GetGPU(i)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if gpu.Advertised != tt.advertised || gpu.OvercommitRatio != tt.ratio {
+			t.Errorf("gpu %d: advertised %v with ratio %v, want %v with ratio %v", i, gpu.Advertised, gpu.OvercommitRatio, tt.advertised, tt.ratio)
+		}
+	}
+	if got, want := len(m.GetMemoryDevs()), 24+48+64; got != want {
+		t.Errorf("got %d memory devices, want %d", got, want)
+	}
+}
+
+func TestReservedMemory(t *testing.T) {
+	lib := NewFakeNVML(
+		&FakeDevice{UUID: "GPU-t4", Name: "Tesla T4", Memory: (16 * GiB).Bytes(), ComputeCapability: [2]int{7, 5}},
+		&FakeDevice{UUID: "GPU-a100", Name: "NVIDIA A100-SXM4-40GB", Minor: 1, Memory: (40 * GiB).Bytes(), ComputeCapability: [2]int{8, 0}},
+	)
+	opts := testOptions()
+	opts.ReservedMemory = Reservation{Percent: 10}
+	opts.ReservedMemoryByModel = map[string]Reservation{"Tesla T4": {Memory: GiB}}
+	m, err := NewGPUManagerWithNVML(lib, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		reserved   Quantity
+		advertised Quantity
+	}{
+		{GiB, 15 * GiB},
+		{4 * GiB, 36 * GiB},
+	}
+	for i, tt := range tests {
+		gpu, err := m.GetGPU(i)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if gpu.Reserved != tt.reserved || gpu.Advertised != tt.advertised {
+			t.Errorf("gpu %d: reserved %v and advertised %v, want %v and %v", i, gpu.Reserved, gpu.Advertised, tt.reserved, tt.advertised)
+		}
+		if got, want := len(m.GetMemoryDevsOf(i)), int(tt.advertised/GiB); got != want {
+			t.Errorf("gpu %d: got %d memory devices, want %d", i, got, want)
+		}
+	}
+
+	// the memory left once reserved is overcommitted
+	opts = testOptions()
+	opts.ReservedMemory = Reservation{Memory: GiB}
+	opts.OvercommitRatio = 2
+	gpu, err := newTestManager(t, "16Gi", opts).GetGPU(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gpu.Reserved != GiB || gpu.Advertised != 30*GiB {
+		t.Errorf("reserved %v and advertised %v, want %v and %v", gpu.Reserved, gpu.Advertised, GiB, 30*GiB)
+	}
+}
+
+func TestOvercommitRatioValidate(t *testing.T) {
+	for _, ratio := range []float64{1, 1.5, 4} {
+		opts := testOptions()
+		opts.OvercommitRatio = ratio
+		if err := opts.Validate(); err != nil {
+			t.Errorf("ratio %v: %v", ratio, err)
+		}
+	}
+	for _, ratio := range []float64{0, 0.5, math.NaN(), math.Inf(1), math.Inf(-1)} {
+		opts := testOptions()
+		opts.OvercommitRatio = ratio
+		if err := opts.Validate(); err == nil {
+			t.Errorf("ratio %v is valid, want error", ratio)
+		}
+	}
+}
+
+func TestModeConflict(t *testing.T) {
+	opts := testOptions()
+	opts.ExclusiveGPUs = Selector{"1"}
+	opts.SharedGPUs = Selector{"1"}
+	_, err := NewMockManager("2Gi,2Gi", opts)
+	if !errors.Is(err, ErrInvalidConfig) {
+		t.Fatalf("got error %v, want %v", err, ErrInvalidConfig)
+	}
+}
+
+func TestModes(t *testing.T) {
+	opts := testOptions()
+	opts.ExclusiveGPUs = Selector{"0"}
+	opts.SharedGPUs = Selector{"1"}
+	m := newTestManager(t, "2Gi,2Gi,2Gi", opts)
+
+	if got, want := len(m.GetGPUDevs()), 2; got != want {
+		t.Errorf("got %d gpu devices, want %d", got, want)
+	}
+	if got, want := len(m.GetMemoryDevs()), 4; got != want {
+		t.Errorf("got %d memory devices, want %d", got, want)
+	}
+	if m.IsMemoryDev("MEM-0-0") || m.IsCoreDev("CORE-0-0") {
+		t.Errorf("exclusive gpu 0 is offered as memory or core devices")
+	}
+}
+
+func TestMaxMemoryDevs(t *testing.T) {
+	opts := testOptions()
+	opts.MemoryUnit = 256 * MiB
+	opts.MaxMemoryDevs = 1000
+	devs := "80Gi,80Gi,80Gi,80Gi,80Gi,80Gi,80Gi,80Gi"
+	m := newTestManager(t, devs, opts)
+	if got, want := m.GetMemoryUnit(), GiB; got != want {
+		t.Errorf("got memory unit %v, want %v", got, want)
+	}
+	if got, want := len(m.GetMemoryDevs()), 640; got != want {
+		t.Errorf("got %d memory devices, want %d", got, want)
+	}
+
+	opts.MaxMemoryDevs = 2560
+	m = newTestManager(t, devs, opts)
+	if got := m.GetMemoryUnit(); got != opts.MemoryUnit {
+		t.Errorf("got memory unit %v, want %v", got, opts.MemoryUnit)
+	}
+	if got := len(m.GetMemoryDevs()); got != opts.MaxMemoryDevs {
+		t.Errorf("got %d memory devices, want %d", got, opts.MaxMemoryDevs)
+	}
+	for i := 0; i < 8; i++ {
+		if got := len(m.GetMemoryDevsOf(i)); got != 320 {
+			t.Errorf("gpu %d: got %d memory devices, want 320", i, got)
+		}
+	}
+}
+
+// benchDevs are 10 GPUs of 80Gi, which are 102400 memory devices of benchUnit.
+const (
+	benchDevs = "80Gi,80Gi,80Gi,80Gi,80Gi,80Gi,80Gi,80Gi,80Gi,80Gi"
+	benchUnit = 8 * MiB
+)
+
+// newBenchManager returns a manager of benchDevs sliced in benchUnit.
+func newBenchManager(b *testing.B) *GPUManager {
+	opts := testOptions()
+	opts.MemoryUnit = benchUnit
+	return newTestManager(b, benchDevs, opts)
+}
+
+func BenchmarkSetHealth(b *testing.B) {
+	m := newBenchManager(b)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		m.SetHealth(0, pluginapi.Unhealthy)
+		m.SetHealth(0, pluginapi.Healthy)
+	}
+}
+
+func BenchmarkGetMemoryDevs(b *testing.B) {
+	m := newBenchManager(b)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		m.GetMemoryDevs()
+	}
+}
+
+func BenchmarkValidateMemoryAllocation(b *testing.B) {
+	m := newBenchManager(b)
+	devs := ids(m.GetMemoryDevsOf(9))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := ValidateMemoryAllocation(m, devs); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestValidateMemoryAllocation(t *testing.T) {
+	opts := testOptions()
+	opts.MemoryUnit = GiB
+	m := newTestManager(t, "4Gi,4Gi", opts)
+	uuid := "GPU-00000000-0000-0000-0000-000000000001"
+
+	tests := []struct {
+		ids   []string
+		index int
+		err   bool
+	}{
+		{ids: []string{"MEM-0-0", "MEM-0-3"}, index: 0},
+		{ids: []string{"MEM-1-0", "MEM-" + uuid + "-1"}, index: 1},
+		{ids: []string{"MEM-0-0", "MEM-1-0"}, err: true},
+		{ids: []string{"MEM-1-0", "MEM-0-0", "MEM-1-1"}, err: true},
+		{ids: []string{"MEM-0-4"}, err: true},
+		{ids: []string{"GPU-0"}, err: true},
+		{ids: nil, err: true},
+	}
+	for _, tt := range tests {
+		index, err := ValidateMemoryAllocation(m, tt.ids)
+		if tt.err {
+			if err == nil {
+				t.Errorf("ValidateMemoryAllocation(%v) = %d, want error", tt.ids, index)
+			}
+			continue
+		}
+		if err != nil || index != tt.index {
+			t.Errorf("ValidateMemoryAllocation(%v) = %d, %v, want %d", tt.ids, index, err, tt.index)
+		}
+	}
+}
+
+func TestGPUManagerWithFakeNVML(t *testing.T) {
+	a100 := &FakeDevice{
+		UUID:              "GPU-a100",
+		Name:              "NVIDIA A100-SXM4-40GB",
+		Minor:             2,
+		Memory:            (40 * GiB).Bytes(),
+		PciBusID:          "00000000:3B:00.0",
+		NumaNode:          1,
+		ComputeCapability: [2]int{8, 0},
+	}
+	if err := SetFakeMigDevices(a100, "3g.20gb", "1g.5gb", "1g.5gb"); err != nil {
+		t.Fatal(err)
+	}
+	lib := NewFakeNVML(
+		&FakeDevice{
+			UUID:              "GPU-t4",
+			Name:              "Tesla T4",
+			Minor:             0,
+			Memory:            (16 * GiB).Bytes(),
+			PciBusID:          "00000000:1A:00.0",
+			NumaNode:          0,
+			ComputeCapability: [2]int{7, 5},
+		},
+		a100,
+		&FakeDevice{
+			UUID:              "GPU-display",
+			Name:              "Quadro P400",
+			Minor:             1,
+			Memory:            (2 * GiB).Bytes(),
+			PciBusID:          "00000000:AF:00.0",
+			NumaNode:          1,
+			ComputeCapability: [2]int{6, 1},
+		},
+	)
+	opts := testOptions()
+	opts.Filter = Filter{Exclude: Selector{"Quadro*"}}
+	m, err := NewGPUManagerWithNVML(lib, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gpus := m.GetGPUs()
+	if len(gpus) != 2 {
+		t.Fatalf("got %d gpus, want 2", len(gpus))
+	}
+	t4 := gpus[0]
+	if t4.Index != 0 || t4.UUID != "GPU-t4" || t4.Name != "Tesla T4" || t4.Minor != 0 || t4.Memory != 16*GiB ||
+		t4.PciBusID != "00000000:1A:00.0" || t4.NumaNode != 0 || t4.ComputeCapability != "7.5" ||
+		t4.DriverVersion != "470.82.01" || t4.CudaVersion != "11.4" || t4.MigEnabled {
+		t.Errorf("got gpu %+v", t4)
+	}
+	if got := len(m.GetMemoryDevs()); got != 16 {
+		t.Errorf("got %d memory devices, want 16", got)
+	}
+	if got := ids(m.GetGPUDevs()); fmt.Sprint(got) != "[GPU-0]" {
+		t.Errorf("got gpu devices %v, want [GPU-0]", got)
+	}
+
+	mig := gpus[1]
+	if mig.Index != 1 || !mig.MigEnabled || len(mig.MigDevices) != 3 || len(m.GetMemoryDevsOf(1)) != 0 {
+		t.Errorf("got mig gpu %+v", mig)
+	}
+	if got := m.GetMigProfiles(); fmt.Sprint(got) != "[1g.5gb 3g.20gb]" {
+		t.Errorf("got mig profiles %v, want [1g.5gb 3g.20gb]", got)
+	}
+	devs := m.GetMigDevs("1g.5gb")
+	if len(devs) != 2 {
+		t.Fatalf("got %d 1g.5gb devices, want 2", len(devs))
+	}
+	info, err := m.ParseMigDevID(devs[1].ID)
+	if err != nil || info.Parent != 1 || info.Memory != 5*GiB {
+		t.Errorf("ParseMigDevID(%q) = %+v, %v", devs[1].ID, info, err)
+	}
+
+	if err := m.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := lib.DeviceCount(); err == nil {
+		t.Errorf("NVML is still initialized after Close")
+	}
+}
+
+func TestParseMemoryUnit(t *testing.T) {
+	tests := []struct {
+		str  string
+		want Quantity
+		err  bool
+	}{
+		{str: "256Mi", want: 256 * MiB},
+		{str: "1Gi", want: GiB},
+		{str: "2048Mi", want: 2 * GiB},
+		{str: "0Mi", err: true},
+		{str: "512Ki", err: true},
+		{str: "1048577", err: true},
+		{str: "256", err: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseMemoryUnit(tt.str)
+		if tt.err {
+			if err == nil {
+				t.Errorf("ParseMemoryUnit(%q) = %v, want error", tt.str, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("ParseMemoryUnit(%q) = %v, %v, want %v", tt.str, got, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,174 @@
+/*
+ * Copyright 2022 lbf1353@live.com
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package device
+
+import (
+	"fmt"
+	"github.com/NVIDIA/go-nvml/pkg/nvml"
+	"k8s.io/klog/v2"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultIgnoredXids are XIDs caused by applications rather than by the GPU,
+// see https://docs.nvidia.com/deploy/xid-errors/index.html.
+var DefaultIgnoredXids = []uint64{
+	13, // Graphics Engine Exception
+	31, // GPU memory page fault
+	43, // GPU stopped processing
+	45, // Preemptive cleanup, due to previous errors
+	68, // Video processor exception
+}
+
+const healthCheckTimeout = 5 * time.Second
+
+// XidEvent is a critical XID error raised by a GPU.
+type XidEvent struct {
+	// Index of the GPU, -1 if the event could not be attributed to a GPU.
+	Index int
+	Xid   uint64
+}
+
+// EventSource delivers the critical XID events of the GPUs.
+type EventSource interface {
+	// Wait blocks up to timeout for the next event, it returns false if no
+	// event arrived in time.
+	Wait(timeout time.Duration) (XidEvent, bool, error)
+	Close() error
+}
+
+// CheckHealth marks GPUs of m unhealthy when src reports a critical XID which
+// is not in ignored, until stop is closed. An event which can not be attributed
+// to a GPU marks all GPUs unhealthy.
+func CheckHealth(m Manager, src EventSource, ignored []uint64, stop <-chan struct{}) {
+	skip := make(map[uint64]struct{})
+	for _, xid := range ignored {
+		skip[xid] = struct{}{}
+	}
+
+	for {
+		select {
+		case <-stop:
+			return
+		default:
+		}
+
+		ev, ok, err := src.Wait(healthCheckTimeout)
+		if err != nil {
+			klog.ErrorS(err, "failed to wait for gpu events")
+			select {
+			case <-stop:
+				return
+			case <-time.After(time.Second):
+			}
+			continue
+		}
+		if !ok {
+			continue
+		}
+
+		if _, ok := skip[ev.Xid]; ok {
+			klog.InfoS("skip ignored xid event", "index", ev.Index, "xid", ev.Xid)
+			continue
+		}
+
+		klog.InfoS("critical xid event", "index", ev.Index, "xid", ev.Xid)
+		if ev.Index >= 0 {
+			m.SetHealth(ev.Index, pluginapi.Unhealthy)
+			continue
+		}
+		for _, gpu := range m.GetGPUs() {
+			m.SetHealth(gpu.Index, pluginapi.Unhealthy)
+		}
+	}
+}
+
+// ParseXids parses a comma separated list of XIDs.
+func ParseXids(str string) ([]uint64, error) {
+	var xids []uint64
+	for _, s := range strings.Split(str, ",") {
+		s = strings.TrimSpace(s)
+		if len(s) == 0 {
+			continue
+		}
+		xid, err := strconv.ParseUint(s, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid xid %q: %v", s, err)
+		}
+		xids = append(xids, xid)
+	}
+	return xids, nil
+}
+
+// eventSource reports critical XID events through NVML.
+type eventSource struct {
+	set NVMLEventSet
+}
+
+var _ EventSource = &eventSource{}
+
+// newEventSource registers all GPUs of lib which support it for critical XID events.
+func newEventSource(lib NVML) (EventSource, error) {
+	set, err := lib.NewEventSet()
+	if err != nil {
+		return nil, err
+	}
+
+	count, err := lib.DeviceCount()
+	if err != nil {
+		set.Free()
+		return nil, err
+	}
+
+	for i := 0; i < count; i++ {
+		dev, err := lib.DeviceByIndex(i)
+		if err != nil {
+			set.Free()
+			return nil, err
+		}
+
+		supported, err := dev.SupportedEventTypes()
+		if err != nil || supported&nvml.EventTypeXidCriticalError == 0 {
+			klog.InfoS("gpu does not support xid events, skip health check", "index", i)
+			continue
+		}
+
+		if err := dev.RegisterEvents(nvml.EventTypeXidCriticalError, set); err != nil {
+			set.Free()
+			return nil, err
+		}
+	}
+
+	return &eventSource{set: set}, nil
+}
+
+func (s *eventSource) Wait(timeout time.Duration) (XidEvent, bool, error) {
+	e, ok, err := s.set.Wait(timeout)
+	if err != nil || !ok {
+		return XidEvent{}, false, err
+	}
+	if e.Type != nvml.EventTypeXidCriticalError {
+		return XidEvent{}, false, nil
+	}
+	return XidEvent{Index: e.Index, Xid: e.Data}, true, nil
+}
+
+func (s *eventSource) Close() error {
+	return s.set.Free()
+}
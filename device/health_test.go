@@ -0,0 +1,101 @@
+/*
+ * Copyright 2022 lbf1353@live.com
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package device
+
+import (
+	"fmt"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+	"testing"
+	"time"
+)
+
+// gpuHealth returns the health of the gpu devices of m.
+func gpuHealth(m Manager) []string {
+	var health []string
+	for _, dev := range m.GetGPUDevs() {
+		health = append(health, dev.Health)
+	}
+	return health
+}
+
+func TestCheckHealth(t *testing.T) {
+	m := newTestManager(t, "2Gi,2Gi,2Gi", testOptions())
+	lib := m.lib.(*FakeNVML)
+	src, err := m.NewEventSource()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+	changed, cancel := m.Subscribe()
+	defer cancel()
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		CheckHealth(m, src, DefaultIgnoredXids, stop)
+		close(done)
+	}()
+	defer func() {
+		close(stop)
+		// wake CheckHealth up with an ignored xid
+		lib.Xid(-1, 13)
+		<-done
+	}()
+
+	steps := []struct {
+		index int
+		xid   uint64
+		want  []string
+	}{
+		// the ignored xid is handled first and leaves gpu 1 healthy
+		{1, 31, nil},
+		{0, 79, []string{pluginapi.Unhealthy, pluginapi.Healthy, pluginapi.Healthy}},
+		{-1, 48, []string{pluginapi.Unhealthy, pluginapi.Unhealthy, pluginapi.Unhealthy}},
+	}
+	for _, step := range steps {
+		lib.Xid(step.index, step.xid)
+		if step.want == nil {
+			continue
+		}
+		select {
+		case <-changed:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("xid %d on gpu %d: health not changed", step.xid, step.index)
+		}
+		if got := gpuHealth(m); fmt.Sprint(got) != fmt.Sprint(step.want) {
+			t.Errorf("xid %d on gpu %d: got health %v, want %v", step.xid, step.index, got, step.want)
+		}
+	}
+	for _, dev := range m.GetMemoryDevs() {
+		if dev.Health != pluginapi.Unhealthy {
+			t.Errorf("memory device %s is %s, want %s", dev.ID, dev.Health, pluginapi.Unhealthy)
+		}
+	}
+}
+
+func TestParseXids(t *testing.T) {
+	got, err := ParseXids(" 13, 31,,43 ")
+	if err != nil || fmt.Sprint(got) != "[13 31 43]" {
+		t.Errorf("ParseXids = %v, %v, want [13 31 43]", got, err)
+	}
+	if got, err := ParseXids(""); err != nil || len(got) != 0 {
+		t.Errorf("ParseXids(\"\") = %v, %v, want none", got, err)
+	}
+	if _, err := ParseXids("13,xid"); err == nil {
+		t.Errorf("ParseXids(%q) succeeded, want error", "13,xid")
+	}
+}
@@ -0,0 +1,201 @@
+/*
+ * Copyright 2022 lbf1353@live.com
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package device
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// LedgerGracePeriod is how long a claim survives a Sync which does not report
+// it, covering the window between Allocate and kubelet recording the assignment.
+const LedgerGracePeriod = time.Minute
+
+// Ledger records which GPUs of the node are allocated exclusively and which
+// have memory or core slices handed out, so that a GPU is never used both
+// ways at once.
+// It is shared by all device plugins of the node, which subscribe to it to be
+// notified when a GPU changes between free, exclusive and shared.
+type Ledger struct {
+	Notifier
+
+	mu        sync.Mutex
+	exclusive map[int]time.Time
+	shared    map[int]map[string]time.Time
+	// latest is the latest shared claim.
+	latest map[int][]string
+}
+
+// NewLedger returns an empty Ledger.
+func NewLedger() *Ledger {
+	return &Ledger{
+		exclusive: make(map[int]time.Time),
+		shared:    make(map[int]map[string]time.Time),
+	}
+}
+
+// ClaimExclusive records the GPUs at indexes as exclusively allocated. It fails
+// without recording anything if any of them has memory or core slices allocated.
+func (l *Ledger) ClaimExclusive(indexes []int) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for _, idx := range indexes {
+		if len(l.shared[idx]) != 0 {
+			return fmt.Errorf("gpu %d has %d shared devices allocated", idx, len(l.shared[idx]))
+		}
+	}
+
+	before := l.states()
+	now := time.Now()
+	for _, idx := range indexes {
+		l.exclusive[idx] = now
+	}
+	l.notifyIfChanged(before)
+	return nil
+}
+
+// ClaimShared records the memory or core devices in ids, by GPU index, as
+// allocated. It fails without recording anything if any of the GPUs is
+// allocated exclusively.
+func (l *Ledger) ClaimShared(ids map[int][]string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for idx := range ids {
+		if _, ok := l.exclusive[idx]; ok {
+			return fmt.Errorf("gpu %d is allocated exclusively", idx)
+		}
+	}
+
+	before := l.states()
+	now := time.Now()
+	for idx, devs := range ids {
+		if l.shared[idx] == nil {
+			l.shared[idx] = make(map[string]time.Time)
+		}
+		for _, id := range devs {
+			l.shared[idx][id] = now
+		}
+	}
+	l.latest = ids
+	l.notifyIfChanged(before)
+	return nil
+}
+
+// LatestShared returns the devices of the latest successful ClaimShared, by
+// GPU index.
+func (l *Ledger) LatestShared() map[int][]string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	latest := make(map[int][]string, len(l.latest))
+	for idx, ids := range l.latest {
+		latest[idx] = append([]string(nil), ids...)
+	}
+	return latest
+}
+
+// IsExclusive reports whether the GPU at index is allocated exclusively.
+func (l *Ledger) IsExclusive(index int) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	_, ok := l.exclusive[index]
+	return ok
+}
+
+// IsShared reports whether the GPU at index has memory or core devices allocated.
+func (l *Ledger) IsShared(index int) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return len(l.shared[index]) != 0
+}
+
+// Sync replaces the recorded allocations with the ones in use according to
+// kubelet. Claims younger than LedgerGracePeriod are kept even if not reported.
+func (l *Ledger) Sync(exclusive []int, shared map[int][]string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	before := l.states()
+	now := time.Now()
+	for idx, t := range l.exclusive {
+		if now.Sub(t) > LedgerGracePeriod {
+			delete(l.exclusive, idx)
+		}
+	}
+	for idx, ids := range l.shared {
+		for id, t := range ids {
+			if now.Sub(t) > LedgerGracePeriod {
+				delete(ids, id)
+			}
+		}
+		if len(ids) == 0 {
+			delete(l.shared, idx)
+		}
+	}
+
+	for _, idx := range exclusive {
+		l.exclusive[idx] = now
+	}
+	for idx, ids := range shared {
+		if l.shared[idx] == nil {
+			l.shared[idx] = make(map[string]time.Time)
+		}
+		for _, id := range ids {
+			l.shared[idx][id] = now
+		}
+	}
+	l.notifyIfChanged(before)
+}
+
+// gpuState is the allocation state of a GPU as seen by the device plugins.
+type gpuState struct {
+	exclusive bool
+	shared    bool
+}
+
+// states returns the state of every GPU with allocations. l.mu must be held.
+func (l *Ledger) states() map[int]gpuState {
+	states := make(map[int]gpuState)
+	for idx := range l.exclusive {
+		st := states[idx]
+		st.exclusive = true
+		states[idx] = st
+	}
+	for idx, ids := range l.shared {
+		if len(ids) == 0 {
+			continue
+		}
+		st := states[idx]
+		st.shared = true
+		states[idx] = st
+	}
+	return states
+}
+
+// notifyIfChanged notifies subscribers if the GPU states differ from before.
+// l.mu must be held.
+func (l *Ledger) notifyIfChanged(before map[int]gpuState) {
+	if !reflect.DeepEqual(before, l.states()) {
+		l.Notify()
+	}
+}
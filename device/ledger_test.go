@@ -0,0 +1,98 @@
+/*
+ * Copyright 2022 lbf1353@live.com
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package device
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLedgerClaims(t *testing.T) {
+	l := NewLedger()
+	changed, cancel := l.Subscribe()
+	defer cancel()
+
+	if err := l.ClaimExclusive([]int{0}); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.ClaimShared(map[int][]string{1: {"MEM-1-0"}, 2: {"CORE-2-0"}}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-changed:
+	default:
+		t.Errorf("claims not notified")
+	}
+	if !l.IsExclusive(0) || l.IsShared(0) || !l.IsShared(1) || l.IsExclusive(1) || !l.IsShared(2) {
+		t.Errorf("got gpu 0 exclusive %v, gpu 1 and 2 shared %v %v", l.IsExclusive(0), l.IsShared(1), l.IsShared(2))
+	}
+
+	// conflicting claims fail without recording anything
+	if err := l.ClaimShared(map[int][]string{0: {"MEM-0-0"}, 3: {"MEM-3-0"}}); err == nil {
+		t.Errorf("ClaimShared of exclusive gpu 0 succeeded")
+	}
+	if err := l.ClaimExclusive([]int{3, 1}); err == nil {
+		t.Errorf("ClaimExclusive of shared gpu 1 succeeded")
+	}
+	if l.IsShared(0) || l.IsShared(3) || l.IsExclusive(3) {
+		t.Errorf("failed claims recorded gpu 3")
+	}
+	select {
+	case <-changed:
+		t.Errorf("failed claims notified")
+	default:
+	}
+}
+
+func TestLedgerSync(t *testing.T) {
+	l := NewLedger()
+	if err := l.ClaimExclusive([]int{0, 1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.ClaimShared(map[int][]string{2: {"MEM-2-0", "MEM-2-1"}, 3: {"MEM-3-0"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// claims within the grace period survive a sync not reporting them
+	l.Sync(nil, nil)
+	for _, idx := range []int{0, 1} {
+		if !l.IsExclusive(idx) {
+			t.Errorf("gpu %d is not exclusive after sync within the grace period", idx)
+		}
+	}
+	if !l.IsShared(2) || !l.IsShared(3) {
+		t.Errorf("gpu 2 and 3 are not shared after sync within the grace period")
+	}
+
+	expired := time.Now().Add(-2 * LedgerGracePeriod)
+	l.exclusive[0], l.exclusive[1] = expired, expired
+	for _, ids := range l.shared {
+		for id := range ids {
+			ids[id] = expired
+		}
+	}
+	l.Sync([]int{1}, map[int][]string{2: {"MEM-2-1"}})
+	if l.IsExclusive(0) || !l.IsExclusive(1) {
+		t.Errorf("got gpu 0 and 1 exclusive %v %v, want gpu 1 only", l.IsExclusive(0), l.IsExclusive(1))
+	}
+	if !l.IsShared(2) || l.IsShared(3) {
+		t.Errorf("got gpu 2 and 3 shared %v %v, want gpu 2 only", l.IsShared(2), l.IsShared(3))
+	}
+	if _, ok := l.shared[2]["MEM-2-0"]; ok {
+		t.Errorf("released MEM-2-0 is still claimed")
+	}
+}
@@ -0,0 +1,162 @@
+/*
+ * Copyright 2022 lbf1353@live.com
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package device
+
+import (
+	"errors"
+	"fmt"
+	"github.com/NVIDIA/go-nvml/pkg/nvml"
+	"k8s.io/klog/v2"
+	"regexp"
+	"strconv"
+)
+
+// MigProfile is the geometry of a MIG device, named e.g. "1g.10gb" or
+// "1c.3g.40gb" when the compute instance is smaller than the GPU instance.
+type MigProfile struct {
+	// GpuSlices is the number of GPU slices of the GPU instance.
+	GpuSlices int
+	// ComputeSlices is the number of compute slices of the compute instance.
+	ComputeSlices int
+	// MemoryGB is the memory of the GPU instance in GB, rounded up.
+	MemoryGB int
+}
+
+var migProfileRegexp = regexp.MustCompile(`^(?:([1-9][0-9]*)c\.)?([1-9][0-9]*)g\.([1-9][0-9]*)gb$`)
+
+// ParseMigProfile parses a MIG profile name such as "1g.10gb" or "1c.3g.40gb".
+func ParseMigProfile(str string) (MigProfile, error) {
+	m := migProfileRegexp.FindStringSubmatch(str)
+	if m == nil {
+		return MigProfile{}, fmt.Errorf("invalid mig profile %q: must be <n>g.<n>gb or <n>c.<n>g.<n>gb", str)
+	}
+	var p MigProfile
+	p.GpuSlices, _ = strconv.Atoi(m[2])
+	p.MemoryGB, _ = strconv.Atoi(m[3])
+	p.ComputeSlices = p.GpuSlices
+	if len(m[1]) != 0 {
+		p.ComputeSlices, _ = strconv.Atoi(m[1])
+	}
+	if p.ComputeSlices > p.GpuSlices {
+		return MigProfile{}, fmt.Errorf("invalid mig profile %q: more compute slices than gpu slices", str)
+	}
+	return p, nil
+}
+
+func (p MigProfile) String() string {
+	if p.ComputeSlices == p.GpuSlices {
+		return fmt.Sprintf("%dg.%dgb", p.GpuSlices, p.MemoryGB)
+	}
+	return fmt.Sprintf("%dc.%dg.%dgb", p.ComputeSlices, p.GpuSlices, p.MemoryGB)
+}
+
+// migProfileOf returns the profile of a MIG device with attrs.
+func migProfileOf(attrs NVMLMigAttributes) MigProfile {
+	return MigProfile{
+		GpuSlices:     attrs.GpuInstanceSlices,
+		ComputeSlices: attrs.ComputeInstanceSlices,
+		MemoryGB:      int((attrs.MemoryMiB + 1024 - 1) / 1024),
+	}
+}
+
+// MigInfo is the metadata of a MIG device captured at discovery.
+type MigInfo struct {
+	// Parent is the index of the GPU the MIG device is carved out of.
+	Parent int
+	// Index is the index of the MIG device on its parent GPU.
+	Index int
+	UUID  string
+	// Profile is the name of the MIG profile, e.g. "1g.10gb".
+	Profile           string
+	Memory            Quantity
+	GpuInstanceID     int
+	ComputeInstanceID int
+}
+
+// getMigDevices returns the MIG devices of the GPU dev at index.
+func getMigDevices(dev NVMLDevice, index int) ([]MigInfo, error) {
+	count, err := dev.MaxMigDeviceCount()
+	if err != nil {
+		return nil, err
+	}
+
+	var migs []MigInfo
+	for j := 0; j < count; j++ {
+		mig, err := dev.MigDeviceByIndex(j)
+		var nvmlErr *NVMLError
+		if errors.As(err, &nvmlErr) && nvmlErr.Ret == nvml.ERROR_NOT_FOUND {
+			// MIG device slots are sparse.
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		info := MigInfo{Parent: index, Index: j}
+		if info.UUID, err = mig.UUID(); err != nil {
+			return nil, err
+		}
+		mem, err := mig.MemoryTotal()
+		if err != nil {
+			return nil, err
+		}
+		info.Memory = Quantity(mem)
+		attrs, err := mig.MigAttributes()
+		if err != nil {
+			return nil, err
+		}
+		info.Profile = migProfileOf(attrs).String()
+		info.GpuInstanceID = attrs.GpuInstanceID
+		info.ComputeInstanceID = attrs.ComputeInstanceID
+
+		klog.V(6).InfoS("discovered mig device", "gpu", index, "index", j, "uuid", info.UUID, "profile", info.Profile)
+		migs = append(migs, info)
+	}
+	return migs, nil
+}
+
+// SetFakeMigDevices enables MIG on gpu and carves one MIG device per profile
+// out of it, for FakeNVML to serve.
+func SetFakeMigDevices(gpu *FakeDevice, profiles ...string) error {
+	gpu.MigEnabled = true
+	gpu.MigDevices = nil
+	for _, str := range profiles {
+		p, err := ParseMigProfile(str)
+		if err != nil {
+			return err
+		}
+		addFakeMigDevice(gpu, p)
+	}
+	return nil
+}
+
+// addFakeMigDevice carves a MIG device of profile out of gpu.
+func addFakeMigDevice(gpu *FakeDevice, p MigProfile) {
+	i := len(gpu.MigDevices)
+	gpu.MigDevices = append(gpu.MigDevices, &FakeDevice{
+		UUID:                  fmt.Sprintf("MIG-%s-%d", gpu.UUID, i),
+		Name:                  gpu.Name,
+		Minor:                 gpu.Minor,
+		Memory:                (Quantity(p.MemoryGB) * GiB).Bytes(),
+		PciBusID:              gpu.PciBusID,
+		NumaNode:              gpu.NumaNode,
+		ComputeCapability:     gpu.ComputeCapability,
+		GpuInstanceID:         i,
+		GpuInstanceSlices:     p.GpuSlices,
+		ComputeInstanceSlices: p.ComputeSlices,
+	})
+}
@@ -19,66 +19,56 @@ package device
 import (
 	"fmt"
 	"k8s.io/klog/v2"
-	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
 	"strconv"
 	"strings"
 )
 
-type MockManager struct {
-	gpus []*GPU
-}
-
-var _ Manager = &MockManager{}
-
-func NewMockManager(devs string) *MockManager {
+// NewMockManager returns a GPUManager serving one fake GPU per entry of the
+// comma separated memory sizes, e.g. "16Gi,16384Mi". Sizes without suffix
+// are in MiB. A size may be followed by the MIG devices of the GPU, e.g.
+// "40Gi/3g.20gb+2g.10gb+1g.5gb".
+func NewMockManager(devs string, opts Options) (*GPUManager, error) {
 	strs := strings.Split(devs, ",")
-	var gpus []*GPU
+	var fakes []*FakeDevice
 	for i, str := range strs {
-		mem, err := strconv.ParseUint(str, 10, 64)
+		parts := strings.SplitN(str, "/", 2)
+		mem, err := parseMockMemory(parts[0])
 		if err != nil {
-			klog.Fatal("invalid number str", err)
+			return nil, fmt.Errorf("invalid mock device memory: %w", err)
 		}
 		klog.V(6).InfoS("mock devices", "index", i, "memory", mem)
-		gpu := GPU{
-			index:  i,
-			memory: mem,
+		fake := &FakeDevice{
+			UUID:              fmt.Sprintf("GPU-00000000-0000-0000-0000-%012d", i),
+			Name:              "Mock GPU",
+			Minor:             -1,
+			Memory:            mem.Bytes(),
+			PciBusID:          fmt.Sprintf("00000000:%02X:00.0", i+1),
+			NumaNode:          -1,
+			ComputeCapability: [2]int{7, 5},
 		}
-		gpus = append(gpus, &gpu)
-	}
-	return &MockManager{
-		gpus: gpus,
-	}
-}
-
-func (m *MockManager) GetMemoryDevs() []*pluginapi.Device {
-	var devs []*pluginapi.Device
-	for _, gpu := range m.gpus {
-		// minimum unit GiB
-
-		sz := gpu.memory / GiB
-
-		klog.V(6).InfoS("device memory size", "index", gpu.index, "size", sz)
-		for j := uint64(0); j < sz; j++ {
-			dev := pluginapi.Device{
-				ID:     fmt.Sprintf("MEM-%d-%d", gpu.index, j),
-				Health: pluginapi.Healthy,
+		if len(parts) == 2 {
+			if err := SetFakeMigDevices(fake, strings.Split(parts[1], "+")...); err != nil {
+				return nil, fmt.Errorf("invalid mock mig devices: %w", err)
 			}
-			devs = append(devs, &dev)
 		}
+		fakes = append(fakes, fake)
 	}
-
-	klog.V(6).InfoS("total device memory size", "size", len(devs))
-	return devs
+	return NewGPUManagerWithNVML(NewFakeNVML(fakes...), opts)
 }
 
-func (m *MockManager) GetGPUDevs() []*pluginapi.Device {
-	var devs []*pluginapi.Device
-	for _, gpu := range m.gpus {
-		dev := pluginapi.Device{
-			ID:     fmt.Sprintf("GPU-%d", gpu.index),
-			Health: pluginapi.Healthy,
-		}
-		devs = append(devs, &dev)
+// parseMockMemory parses a mock memory size, a plain number being in MiB.
+func parseMockMemory(str string) (Quantity, error) {
+	str = strings.TrimSpace(str)
+	if n, err := strconv.ParseUint(str, 10, 64); err == nil {
+		return Quantity(n) * MiB, nil
 	}
-	return devs
+	return ParseQuantity(str)
+}
+
+// NewEmptyManager returns a GPUManager without GPUs, used to keep the device
+// plugins up and advertising zero devices on nodes without usable GPUs.
+func NewEmptyManager() *GPUManager {
+	// FakeNVML does not fail discovery.
+	m, _ := NewGPUManagerWithNVML(NewFakeNVML(), Options{DeviceIDStrategy: DeviceIDIndex, MemoryUnit: DefaultMemoryUnit, OvercommitRatio: 1})
+	return m
 }
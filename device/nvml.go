@@ -0,0 +1,446 @@
+/*
+ * Copyright 2022 lbf1353@live.com
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package device
+
+import (
+	"fmt"
+	"github.com/NVIDIA/go-nvml/pkg/nvml"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// NVML is the subset of the NVML library used by the device package. It is
+// implemented on top of go-nvml by NewNVML and in memory by FakeNVML.
+type NVML interface {
+	Init() error
+	Shutdown() error
+	DeviceCount() (int, error)
+	DeviceByIndex(idx int) (NVMLDevice, error)
+	NewEventSet() (NVMLEventSet, error)
+	DriverVersion() (string, error)
+	// CudaDriverVersion returns the CUDA version supported by the driver,
+	// as 1000 * major + 10 * minor.
+	CudaDriverVersion() (int, error)
+}
+
+// NVMLDevice is a GPU, or a MIG device of a GPU, as seen by NVML.
+type NVMLDevice interface {
+	UUID() (string, error)
+	Name() (string, error)
+	MinorNumber() (int, error)
+	// MemoryTotal returns the total memory of the device in bytes.
+	MemoryTotal() (uint64, error)
+	PciBusID() (string, error)
+	// NumaNode returns the NUMA node the device is attached to, -1 if unknown.
+	NumaNode() (int, error)
+	CudaComputeCapability() (int, int, error)
+	// MigMode returns the current and pending MIG mode, one of
+	// nvml.DEVICE_MIG_DISABLE or nvml.DEVICE_MIG_ENABLE.
+	MigMode() (int, int, error)
+	MaxMigDeviceCount() (int, error)
+	MigDeviceByIndex(idx int) (NVMLDevice, error)
+	// MigAttributes returns the GPU partition backing a MIG device.
+	MigAttributes() (NVMLMigAttributes, error)
+	// SetMigMode enables or disables MIG, mode being one of
+	// nvml.DEVICE_MIG_DISABLE or nvml.DEVICE_MIG_ENABLE. It returns an
+	// ErrMigPending error if the mode only applies once the GPU is reset.
+	SetMigMode(mode int) error
+	// CreateMigDevice creates a GPU instance and a compute instance of
+	// profile on a GPU with MIG enabled.
+	CreateMigDevice(profile MigProfile) error
+	// DestroyMigDevices destroys all compute and GPU instances of a GPU.
+	DestroyMigDevices() error
+	SupportedEventTypes() (uint64, error)
+	RegisterEvents(types uint64, set NVMLEventSet) error
+}
+
+// NVMLMigAttributes describes the GPU partition backing a MIG device.
+type NVMLMigAttributes struct {
+	GpuInstanceID     int
+	ComputeInstanceID int
+	// GpuInstanceSlices and ComputeInstanceSlices are the number of slices
+	// of the GPU and compute instances.
+	GpuInstanceSlices     int
+	ComputeInstanceSlices int
+	// MemoryMiB is the memory of the GPU instance in MiB.
+	MemoryMiB uint64
+}
+
+// NVMLEvent is an event received from an NVMLEventSet.
+type NVMLEvent struct {
+	// Index of the GPU, -1 if the event could not be attributed to a GPU.
+	Index int
+	Type  uint64
+	Data  uint64
+}
+
+// NVMLEventSet receives the events of the devices registered to it.
+type NVMLEventSet interface {
+	// Wait blocks up to timeout for the next event, it returns false if no
+	// event arrived in time.
+	Wait(timeout time.Duration) (NVMLEvent, bool, error)
+	Free() error
+}
+
+// NVMLError is returned when an NVML call fails.
+type NVMLError struct {
+	Op     string
+	Ret    nvml.Return
+	Reason string
+}
+
+func (e *NVMLError) Error() string {
+	return fmt.Sprintf("unable to %s: %s", e.Op, e.Reason)
+}
+
+// newNVMLError returns the NVMLError of a failed go-nvml call, the library
+// must be loaded.
+func newNVMLError(op string, ret nvml.Return) *NVMLError {
+	return &NVMLError{Op: op, Ret: ret, Reason: nvml.ErrorString(ret)}
+}
+
+type nvmlLib struct{}
+
+var _ NVML = nvmlLib{}
+
+// NewNVML returns the NVML implementation backed by libnvidia-ml.so.
+func NewNVML() NVML {
+	return nvmlLib{}
+}
+
+func (nvmlLib) Init() (err error) {
+	// nvml.Init panics when libnvidia-ml.so can not be loaded.
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%w: %v", ErrNoDriver, r)
+		}
+	}()
+
+	ret := nvml.Init()
+	if ret == nvml.ERROR_LIBRARY_NOT_FOUND || ret == nvml.ERROR_DRIVER_NOT_LOADED {
+		return fmt.Errorf("%w: %v", ErrNoDriver, nvml.ErrorString(ret))
+	}
+	if ret != nvml.SUCCESS {
+		return newNVMLError("initialize NVML", ret)
+	}
+	return nil
+}
+
+func (nvmlLib) Shutdown() error {
+	ret := nvml.Shutdown()
+	if ret != nvml.SUCCESS {
+		return newNVMLError("shutdown NVML", ret)
+	}
+	return nil
+}
+
+func (nvmlLib) DeviceCount() (int, error) {
+	count, ret := nvml.DeviceGetCount()
+	if ret != nvml.SUCCESS {
+		return 0, newNVMLError("get device count", ret)
+	}
+	return count, nil
+}
+
+func (nvmlLib) DeviceByIndex(idx int) (NVMLDevice, error) {
+	dev, ret := nvml.DeviceGetHandleByIndex(idx)
+	if ret != nvml.SUCCESS {
+		return nil, newNVMLError(fmt.Sprintf("get device by index %v", idx), ret)
+	}
+	return nvmlDevice{dev: dev}, nil
+}
+
+func (nvmlLib) NewEventSet() (NVMLEventSet, error) {
+	set, ret := nvml.EventSetCreate()
+	if ret != nvml.SUCCESS {
+		return nil, newNVMLError("create event set", ret)
+	}
+	return nvmlEventSet{set: set}, nil
+}
+
+func (nvmlLib) DriverVersion() (string, error) {
+	version, ret := nvml.SystemGetDriverVersion()
+	if ret != nvml.SUCCESS {
+		return "", newNVMLError("get driver version", ret)
+	}
+	return version, nil
+}
+
+func (nvmlLib) CudaDriverVersion() (int, error) {
+	version, ret := nvml.SystemGetCudaDriverVersion()
+	if ret != nvml.SUCCESS {
+		return 0, newNVMLError("get cuda driver version", ret)
+	}
+	return version, nil
+}
+
+type nvmlDevice struct {
+	dev nvml.Device
+}
+
+var _ NVMLDevice = nvmlDevice{}
+
+func (d nvmlDevice) UUID() (string, error) {
+	uuid, ret := d.dev.GetUUID()
+	if ret != nvml.SUCCESS {
+		return "", newNVMLError("get device uuid", ret)
+	}
+	return uuid, nil
+}
+
+func (d nvmlDevice) Name() (string, error) {
+	name, ret := d.dev.GetName()
+	if ret != nvml.SUCCESS {
+		return "", newNVMLError("get device name", ret)
+	}
+	return name, nil
+}
+
+func (d nvmlDevice) MinorNumber() (int, error) {
+	minor, ret := d.dev.GetMinorNumber()
+	if ret != nvml.SUCCESS {
+		return 0, newNVMLError("get device minor number", ret)
+	}
+	return minor, nil
+}
+
+func (d nvmlDevice) MemoryTotal() (uint64, error) {
+	mem, ret := d.dev.GetMemoryInfo()
+	if ret != nvml.SUCCESS {
+		return 0, newNVMLError("get device memory", ret)
+	}
+	return mem.Total, nil
+}
+
+func (d nvmlDevice) PciBusID() (string, error) {
+	info, ret := d.dev.GetPciInfo()
+	if ret != nvml.SUCCESS {
+		return "", newNVMLError("get device pci info", ret)
+	}
+	var id []byte
+	for _, c := range info.BusId {
+		if c == 0 {
+			break
+		}
+		id = append(id, byte(c))
+	}
+	return string(id), nil
+}
+
+// NumaNode reads the NUMA node of the device from sysfs, NVML does not report it.
+func (d nvmlDevice) NumaNode() (int, error) {
+	busID, err := d.PciBusID()
+	if err != nil {
+		return 0, err
+	}
+	b, err := ioutil.ReadFile(filepath.Join("/sys/bus/pci/devices", normalizePciBusID(busID), "numa_node"))
+	if err != nil {
+		return -1, nil
+	}
+	node, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil || node < 0 {
+		return -1, nil
+	}
+	return node, nil
+}
+
+func (d nvmlDevice) CudaComputeCapability() (int, int, error) {
+	major, minor, ret := d.dev.GetCudaComputeCapability()
+	if ret != nvml.SUCCESS {
+		return 0, 0, newNVMLError("get cuda compute capability", ret)
+	}
+	return major, minor, nil
+}
+
+func (d nvmlDevice) MigMode() (int, int, error) {
+	current, pending, ret := d.dev.GetMigMode()
+	if ret == nvml.ERROR_NOT_SUPPORTED {
+		return nvml.DEVICE_MIG_DISABLE, nvml.DEVICE_MIG_DISABLE, nil
+	}
+	if ret != nvml.SUCCESS {
+		return 0, 0, newNVMLError("get device mig mode", ret)
+	}
+	return current, pending, nil
+}
+
+func (d nvmlDevice) MaxMigDeviceCount() (int, error) {
+	count, ret := d.dev.GetMaxMigDeviceCount()
+	if ret != nvml.SUCCESS {
+		return 0, newNVMLError("get max mig device count", ret)
+	}
+	return count, nil
+}
+
+func (d nvmlDevice) MigDeviceByIndex(idx int) (NVMLDevice, error) {
+	dev, ret := d.dev.GetMigDeviceHandleByIndex(idx)
+	if ret != nvml.SUCCESS {
+		return nil, newNVMLError(fmt.Sprintf("get mig device by index %v", idx), ret)
+	}
+	return nvmlDevice{dev: dev}, nil
+}
+
+func (d nvmlDevice) MigAttributes() (NVMLMigAttributes, error) {
+	attrs, ret := d.dev.GetAttributes()
+	if ret != nvml.SUCCESS {
+		return NVMLMigAttributes{}, newNVMLError("get mig device attributes", ret)
+	}
+	gi, ret := d.dev.GetGpuInstanceId()
+	if ret != nvml.SUCCESS {
+		return NVMLMigAttributes{}, newNVMLError("get gpu instance id", ret)
+	}
+	ci, ret := d.dev.GetComputeInstanceId()
+	if ret != nvml.SUCCESS {
+		return NVMLMigAttributes{}, newNVMLError("get compute instance id", ret)
+	}
+	return NVMLMigAttributes{
+		GpuInstanceID:         gi,
+		ComputeInstanceID:     ci,
+		GpuInstanceSlices:     int(attrs.GpuInstanceSliceCount),
+		ComputeInstanceSlices: int(attrs.ComputeInstanceSliceCount),
+		MemoryMiB:             attrs.MemorySizeMB,
+	}, nil
+}
+
+func (d nvmlDevice) SetMigMode(mode int) error {
+	// go-nvml returns the activation status first and the result of the
+	// call second.
+	activation, ret := d.dev.SetMigMode(mode)
+	if ret != nvml.SUCCESS {
+		return newNVMLError("set mig mode", ret)
+	}
+	if activation != nvml.SUCCESS {
+		return fmt.Errorf("%w: %v", ErrMigPending, newNVMLError("activate mig mode", activation))
+	}
+	return nil
+}
+
+func (d nvmlDevice) CreateMigDevice(profile MigProfile) error {
+	for id := 0; id < nvml.GPU_INSTANCE_PROFILE_COUNT; id++ {
+		info, ret := d.dev.GetGpuInstanceProfileInfo(id)
+		if ret != nvml.SUCCESS {
+			continue
+		}
+		if int(info.SliceCount) != profile.GpuSlices || int((info.MemorySizeMB+1024-1)/1024) != profile.MemoryGB {
+			continue
+		}
+		gi, ret := d.dev.CreateGpuInstance(&info)
+		if ret != nvml.SUCCESS {
+			return newNVMLError(fmt.Sprintf("create gpu instance %s", profile), ret)
+		}
+		for cid := 0; cid < nvml.COMPUTE_INSTANCE_PROFILE_COUNT; cid++ {
+			ciInfo, ret := gi.GetComputeInstanceProfileInfo(cid, nvml.COMPUTE_INSTANCE_ENGINE_PROFILE_SHARED)
+			if ret != nvml.SUCCESS || int(ciInfo.SliceCount) != profile.ComputeSlices {
+				continue
+			}
+			if _, ret := gi.CreateComputeInstance(&ciInfo); ret != nvml.SUCCESS {
+				gi.Destroy()
+				return newNVMLError(fmt.Sprintf("create compute instance %s", profile), ret)
+			}
+			return nil
+		}
+		gi.Destroy()
+		return fmt.Errorf("unable to create mig device %s: no matching compute instance profile", profile)
+	}
+	return fmt.Errorf("unable to create mig device %s: profile not supported by the gpu", profile)
+}
+
+func (d nvmlDevice) DestroyMigDevices() error {
+	for id := 0; id < nvml.GPU_INSTANCE_PROFILE_COUNT; id++ {
+		info, ret := d.dev.GetGpuInstanceProfileInfo(id)
+		if ret != nvml.SUCCESS {
+			continue
+		}
+		gis, ret := d.dev.GetGpuInstances(&info)
+		if ret != nvml.SUCCESS {
+			return newNVMLError("get gpu instances", ret)
+		}
+		for _, gi := range gis {
+			for cid := 0; cid < nvml.COMPUTE_INSTANCE_PROFILE_COUNT; cid++ {
+				ciInfo, ret := gi.GetComputeInstanceProfileInfo(cid, nvml.COMPUTE_INSTANCE_ENGINE_PROFILE_SHARED)
+				if ret != nvml.SUCCESS {
+					continue
+				}
+				cis, ret := gi.GetComputeInstances(&ciInfo)
+				if ret != nvml.SUCCESS {
+					return newNVMLError("get compute instances", ret)
+				}
+				for _, ci := range cis {
+					if ret := ci.Destroy(); ret != nvml.SUCCESS {
+						return newNVMLError("destroy compute instance", ret)
+					}
+				}
+			}
+			if ret := gi.Destroy(); ret != nvml.SUCCESS {
+				return newNVMLError("destroy gpu instance", ret)
+			}
+		}
+	}
+	return nil
+}
+
+func (d nvmlDevice) SupportedEventTypes() (uint64, error) {
+	types, ret := d.dev.GetSupportedEventTypes()
+	if ret != nvml.SUCCESS {
+		return 0, newNVMLError("get supported event types", ret)
+	}
+	return types, nil
+}
+
+func (d nvmlDevice) RegisterEvents(types uint64, set NVMLEventSet) error {
+	s, ok := set.(nvmlEventSet)
+	if !ok {
+		return fmt.Errorf("unable to register events: foreign event set %T", set)
+	}
+	ret := d.dev.RegisterEvents(types, s.set)
+	if ret != nvml.SUCCESS {
+		return newNVMLError("register events", ret)
+	}
+	return nil
+}
+
+type nvmlEventSet struct {
+	set nvml.EventSet
+}
+
+var _ NVMLEventSet = nvmlEventSet{}
+
+func (s nvmlEventSet) Wait(timeout time.Duration) (NVMLEvent, bool, error) {
+	e, ret := s.set.Wait(uint32(timeout.Milliseconds()))
+	if ret == nvml.ERROR_TIMEOUT {
+		return NVMLEvent{}, false, nil
+	}
+	if ret != nvml.SUCCESS {
+		return NVMLEvent{}, false, newNVMLError("wait for events", ret)
+	}
+
+	idx, ret := e.Device.GetIndex()
+	if ret != nvml.SUCCESS {
+		idx = -1
+	}
+	return NVMLEvent{Index: idx, Type: e.EventType, Data: e.EventData}, true, nil
+}
+
+func (s nvmlEventSet) Free() error {
+	ret := s.set.Free()
+	if ret != nvml.SUCCESS {
+		return newNVMLError("free event set", ret)
+	}
+	return nil
+}
@@ -0,0 +1,325 @@
+/*
+ * Copyright 2022 lbf1353@live.com
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package device
+
+import (
+	"fmt"
+	"github.com/NVIDIA/go-nvml/pkg/nvml"
+	"sync"
+	"time"
+)
+
+// FakeDevice describes a GPU, or a MIG device of a GPU, served by FakeNVML.
+type FakeDevice struct {
+	UUID  string
+	Name  string
+	Minor int
+	// Memory is the total memory of the device in bytes.
+	Memory   uint64
+	PciBusID string
+	// NumaNode is -1 if unknown.
+	NumaNode int
+	// ComputeCapability is the major and minor CUDA compute capability.
+	ComputeCapability [2]int
+	MigEnabled        bool
+	MigDevices        []*FakeDevice
+	// ResetRequired leaves MIG mode changes pending, as if the GPU had to
+	// be reset for them to apply.
+	ResetRequired bool
+	// pendingMig is the MIG mode pending a reset, if ResetRequired.
+	pendingMig *bool
+	// GpuInstanceID, ComputeInstanceID and the slice counts describe the
+	// partition of the parent GPU backing a MIG device.
+	GpuInstanceID         int
+	ComputeInstanceID     int
+	GpuInstanceSlices     int
+	ComputeInstanceSlices int
+}
+
+// fakeMigSlices is the number of GPU slices a fake GPU can be partitioned in,
+// like an A100.
+const fakeMigSlices = 7
+
+// FakeNVML is an in-memory NVML, used to run the device package without GPUs.
+type FakeNVML struct {
+	// Driver and CudaDriver are the reported driver and CUDA versions.
+	Driver     string
+	CudaDriver int
+
+	mu          sync.Mutex
+	devices     []*FakeDevice
+	initialized bool
+	sets        []*fakeEventSet
+}
+
+var _ NVML = &FakeNVML{}
+
+// NewFakeNVML returns a FakeNVML serving devices, in index order.
+func NewFakeNVML(devices ...*FakeDevice) *FakeNVML {
+	return &FakeNVML{
+		Driver:     "470.82.01",
+		CudaDriver: 11040,
+		devices:    devices,
+	}
+}
+
+func fakeError(op string, ret nvml.Return, reason string) *NVMLError {
+	return &NVMLError{Op: op, Ret: ret, Reason: reason}
+}
+
+func (f *FakeNVML) Init() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.initialized = true
+	return nil
+}
+
+func (f *FakeNVML) Shutdown() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if !f.initialized {
+		return fakeError("shutdown NVML", nvml.ERROR_UNINITIALIZED, "Uninitialized")
+	}
+	f.initialized = false
+	return nil
+}
+
+func (f *FakeNVML) DeviceCount() (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if !f.initialized {
+		return 0, fakeError("get device count", nvml.ERROR_UNINITIALIZED, "Uninitialized")
+	}
+	return len(f.devices), nil
+}
+
+func (f *FakeNVML) DeviceByIndex(idx int) (NVMLDevice, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	op := fmt.Sprintf("get device by index %v", idx)
+	if !f.initialized {
+		return nil, fakeError(op, nvml.ERROR_UNINITIALIZED, "Uninitialized")
+	}
+	if idx < 0 || idx >= len(f.devices) {
+		return nil, fakeError(op, nvml.ERROR_INVALID_ARGUMENT, "Invalid Argument")
+	}
+	return &fakeDevice{index: idx, desc: f.devices[idx]}, nil
+}
+
+func (f *FakeNVML) NewEventSet() (NVMLEventSet, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if !f.initialized {
+		return nil, fakeError("create event set", nvml.ERROR_UNINITIALIZED, "Uninitialized")
+	}
+	set := &fakeEventSet{
+		events:     make(chan NVMLEvent, 16),
+		registered: make(map[int]uint64),
+	}
+	f.sets = append(f.sets, set)
+	return set, nil
+}
+
+func (f *FakeNVML) DriverVersion() (string, error) {
+	return f.Driver, nil
+}
+
+func (f *FakeNVML) CudaDriverVersion() (int, error) {
+	return f.CudaDriver, nil
+}
+
+// Xid raises the critical XID error xid on the GPU at index, index -1 raises
+// an error which can not be attributed to a GPU.
+func (f *FakeNVML) Xid(index int, xid uint64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, set := range f.sets {
+		set.send(NVMLEvent{Index: index, Type: nvml.EventTypeXidCriticalError, Data: xid})
+	}
+}
+
+type fakeDevice struct {
+	// index of the GPU, -1 for MIG devices.
+	index int
+	desc  *FakeDevice
+}
+
+var _ NVMLDevice = &fakeDevice{}
+
+func (d *fakeDevice) UUID() (string, error) {
+	return d.desc.UUID, nil
+}
+
+func (d *fakeDevice) Name() (string, error) {
+	return d.desc.Name, nil
+}
+
+func (d *fakeDevice) MinorNumber() (int, error) {
+	return d.desc.Minor, nil
+}
+
+func (d *fakeDevice) MemoryTotal() (uint64, error) {
+	return d.desc.Memory, nil
+}
+
+func (d *fakeDevice) PciBusID() (string, error) {
+	return d.desc.PciBusID, nil
+}
+
+func (d *fakeDevice) NumaNode() (int, error) {
+	return d.desc.NumaNode, nil
+}
+
+func (d *fakeDevice) CudaComputeCapability() (int, int, error) {
+	return d.desc.ComputeCapability[0], d.desc.ComputeCapability[1], nil
+}
+
+func (d *fakeDevice) MigMode() (int, int, error) {
+	mode := func(enabled bool) int {
+		if enabled {
+			return nvml.DEVICE_MIG_ENABLE
+		}
+		return nvml.DEVICE_MIG_DISABLE
+	}
+	pending := d.desc.MigEnabled
+	if d.desc.pendingMig != nil {
+		pending = *d.desc.pendingMig
+	}
+	return mode(d.desc.MigEnabled), mode(pending), nil
+}
+
+func (d *fakeDevice) MaxMigDeviceCount() (int, error) {
+	return len(d.desc.MigDevices), nil
+}
+
+func (d *fakeDevice) MigDeviceByIndex(idx int) (NVMLDevice, error) {
+	if !d.desc.MigEnabled || idx < 0 || idx >= len(d.desc.MigDevices) {
+		return nil, fakeError(fmt.Sprintf("get mig device by index %v", idx), nvml.ERROR_NOT_FOUND, "Not Found")
+	}
+	return &fakeDevice{index: -1, desc: d.desc.MigDevices[idx]}, nil
+}
+
+func (d *fakeDevice) MigAttributes() (NVMLMigAttributes, error) {
+	if d.index >= 0 {
+		return NVMLMigAttributes{}, fakeError("get mig device attributes", nvml.ERROR_NOT_SUPPORTED, "Not Supported")
+	}
+	return NVMLMigAttributes{
+		GpuInstanceID:         d.desc.GpuInstanceID,
+		ComputeInstanceID:     d.desc.ComputeInstanceID,
+		GpuInstanceSlices:     d.desc.GpuInstanceSlices,
+		ComputeInstanceSlices: d.desc.ComputeInstanceSlices,
+		MemoryMiB:             Quantity(d.desc.Memory).MiB(),
+	}, nil
+}
+
+func (d *fakeDevice) SetMigMode(mode int) error {
+	if d.index < 0 {
+		return fakeError("set mig mode", nvml.ERROR_NOT_SUPPORTED, "Not Supported")
+	}
+	enabled := mode == nvml.DEVICE_MIG_ENABLE
+	if d.desc.ResetRequired && enabled != d.desc.MigEnabled {
+		d.desc.pendingMig = &enabled
+		return fmt.Errorf("%w: %v", ErrMigPending, fakeError("activate mig mode", nvml.ERROR_IN_USE, "In use by another client"))
+	}
+	d.desc.MigEnabled = enabled
+	if !d.desc.MigEnabled {
+		d.desc.MigDevices = nil
+	}
+	return nil
+}
+
+func (d *fakeDevice) CreateMigDevice(profile MigProfile) error {
+	if !d.desc.MigEnabled {
+		return fakeError(fmt.Sprintf("create gpu instance %s", profile), nvml.ERROR_NOT_SUPPORTED, "Not Supported")
+	}
+	slices := profile.GpuSlices
+	for _, mig := range d.desc.MigDevices {
+		slices += mig.GpuInstanceSlices
+	}
+	if slices > fakeMigSlices {
+		return fakeError(fmt.Sprintf("create gpu instance %s", profile), nvml.ERROR_INSUFFICIENT_RESOURCES, "Insufficient Resources")
+	}
+	addFakeMigDevice(d.desc, profile)
+	return nil
+}
+
+func (d *fakeDevice) DestroyMigDevices() error {
+	d.desc.MigDevices = nil
+	return nil
+}
+
+func (d *fakeDevice) SupportedEventTypes() (uint64, error) {
+	return nvml.EventTypeXidCriticalError, nil
+}
+
+func (d *fakeDevice) RegisterEvents(types uint64, set NVMLEventSet) error {
+	s, ok := set.(*fakeEventSet)
+	if !ok {
+		return fmt.Errorf("unable to register events: foreign event set %T", set)
+	}
+	s.register(d.index, types)
+	return nil
+}
+
+type fakeEventSet struct {
+	mu         sync.Mutex
+	events     chan NVMLEvent
+	registered map[int]uint64
+}
+
+var _ NVMLEventSet = &fakeEventSet{}
+
+func (s *fakeEventSet) register(index int, types uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.registered[index] |= types
+}
+
+// send queues ev if the set is registered for it, events which can not be
+// attributed to a GPU are delivered to all sets.
+func (s *fakeEventSet) send(ev NVMLEvent) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if ev.Index >= 0 && s.registered[ev.Index]&ev.Type == 0 {
+		return
+	}
+	select {
+	case s.events <- ev:
+	default:
+	}
+}
+
+func (s *fakeEventSet) Wait(timeout time.Duration) (NVMLEvent, bool, error) {
+	select {
+	case ev := <-s.events:
+		return ev, true, nil
+	case <-time.After(timeout):
+		return NVMLEvent{}, false, nil
+	}
+}
+
+func (s *fakeEventSet) Free() error {
+	return nil
+}
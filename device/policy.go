@@ -0,0 +1,95 @@
+/*
+ * Copyright 2022 lbf1353@live.com
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package device
+
+import (
+	"fmt"
+)
+
+const (
+	PolicyBinpack = "binpack"
+	PolicySpread  = "spread"
+	PolicyIndex   = "index"
+)
+
+// GPUUsage summarizes the memory slices of one GPU when serving an allocation request.
+type GPUUsage struct {
+	Index int
+	// Total is the number of memory slices advertised for the GPU.
+	Total int
+	// Free is the number of memory slices which can be handed to the request.
+	Free int
+}
+
+// Used returns the number of memory slices already allocated on the GPU.
+func (u GPUUsage) Used() int {
+	return u.Total - u.Free
+}
+
+// Policy decides which GPU a memory request should land on.
+type Policy interface {
+	// Less reports whether GPU a should be preferred over GPU b.
+	Less(a, b GPUUsage) bool
+}
+
+// NewPolicy returns the Policy registered under name.
+func NewPolicy(name string) (Policy, error) {
+	switch name {
+	case PolicyBinpack:
+		return BinpackPolicy{}, nil
+	case PolicySpread:
+		return SpreadPolicy{}, nil
+	case PolicyIndex:
+		return IndexPolicy{}, nil
+	}
+	return nil, fmt.Errorf("unknown allocation policy: %s", name)
+}
+
+// BinpackPolicy prefers the GPU which is already most used, so that whole GPUs
+// are kept free for large requests.
+type BinpackPolicy struct{}
+
+func (BinpackPolicy) Less(a, b GPUUsage) bool {
+	if a.Used() != b.Used() {
+		return a.Used() > b.Used()
+	}
+	if a.Free != b.Free {
+		return a.Free < b.Free
+	}
+	return a.Index < b.Index
+}
+
+// SpreadPolicy prefers the GPU which is least used, so that workloads share
+// GPUs with as few neighbours as possible.
+type SpreadPolicy struct{}
+
+func (SpreadPolicy) Less(a, b GPUUsage) bool {
+	if a.Used() != b.Used() {
+		return a.Used() < b.Used()
+	}
+	if a.Free != b.Free {
+		return a.Free > b.Free
+	}
+	return a.Index < b.Index
+}
+
+// IndexPolicy prefers the GPU with the lowest index.
+type IndexPolicy struct{}
+
+func (IndexPolicy) Less(a, b GPUUsage) bool {
+	return a.Index < b.Index
+}
@@ -0,0 +1,72 @@
+/*
+ * Copyright 2022 lbf1353@live.com
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package device
+
+import (
+	"sort"
+	"testing"
+)
+
+func TestPolicies(t *testing.T) {
+	usages := []GPUUsage{
+		{Index: 0, Total: 16, Free: 16},
+		{Index: 1, Total: 16, Free: 4},
+		{Index: 2, Total: 32, Free: 20},
+		{Index: 3, Total: 16, Free: 16},
+		{Index: 4, Total: 8, Free: 8},
+	}
+	tests := []struct {
+		name string
+		want []int
+	}{
+		// most used first, then the least free
+		{PolicyBinpack, []int{1, 2, 4, 0, 3}},
+		// least used first, then the most free
+		{PolicySpread, []int{0, 3, 4, 2, 1}},
+		{PolicyIndex, []int{0, 1, 2, 3, 4}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			policy, err := NewPolicy(tt.name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			sorted := append([]GPUUsage(nil), usages...)
+			// start from the reverse order so that ties are not resolved by
+			// a stable sort
+			for i, j := 0, len(sorted)-1; i < j; i, j = i+1, j-1 {
+				sorted[i], sorted[j] = sorted[j], sorted[i]
+			}
+			sort.Slice(sorted, func(i, j int) bool { return policy.Less(sorted[i], sorted[j]) })
+			var got []int
+			for _, u := range sorted {
+				got = append(got, u.Index)
+			}
+			for i := range tt.want {
+				if got[i] != tt.want[i] {
+					t.Fatalf("got order %v, want %v", got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestNewPolicyUnknown(t *testing.T) {
+	if _, err := NewPolicy("random"); err == nil {
+		t.Errorf("NewPolicy(%q) succeeded, want error", "random")
+	}
+}
@@ -0,0 +1,86 @@
+/*
+ * Copyright 2022 lbf1353@live.com
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package device
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Quantity is an amount of memory in bytes. NVML reports bytes, conversions to
+// other units are explicit through the unit constants and methods.
+type Quantity uint64
+
+const (
+	Byte Quantity = 1
+	KiB           = 1024 * Byte
+	MiB           = 1024 * KiB
+	GiB           = 1024 * MiB
+)
+
+// quantitySuffixes are the units accepted by ParseQuantity, largest first.
+var quantitySuffixes = []struct {
+	suffix string
+	unit   Quantity
+}{
+	{"Gi", GiB},
+	{"Mi", MiB},
+	{"Ki", KiB},
+}
+
+// ParseQuantity parses a memory quantity with a binary suffix, e.g. "16Gi",
+// "16384Mi" or "512Ki". A number without suffix is in bytes.
+func ParseQuantity(str string) (Quantity, error) {
+	str = strings.TrimSpace(str)
+	unit, num := Byte, str
+	for _, s := range quantitySuffixes {
+		if strings.HasSuffix(str, s.suffix) {
+			unit, num = s.unit, strings.TrimSuffix(str, s.suffix)
+			break
+		}
+	}
+	n, err := strconv.ParseUint(num, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid memory quantity %q: must be a number with an optional Ki, Mi or Gi suffix", str)
+	}
+	if n > uint64(^Quantity(0)/unit) {
+		return 0, fmt.Errorf("invalid memory quantity %q: too large", str)
+	}
+	return Quantity(n) * unit, nil
+}
+
+// Bytes returns the quantity in bytes.
+func (q Quantity) Bytes() uint64 {
+	return uint64(q)
+}
+
+// MiB returns the quantity in MiB, rounded down.
+func (q Quantity) MiB() uint64 {
+	return uint64(q / MiB)
+}
+
+// String formats the quantity with the largest suffix dividing it, the way
+// ParseQuantity accepts it.
+func (q Quantity) String() string {
+	for _, s := range quantitySuffixes {
+		if q != 0 && q%s.unit == 0 {
+			return fmt.Sprintf("%d%s", q/s.unit, s.suffix)
+		}
+	}
+	return strconv.FormatUint(uint64(q), 10)
+}
@@ -0,0 +1,122 @@
+/*
+ * Copyright 2022 lbf1353@live.com
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package device
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestParseQuantity(t *testing.T) {
+	tests := []struct {
+		str  string
+		want Quantity
+		err  bool
+	}{
+		{str: "16Gi", want: 16 * GiB},
+		{str: "16384Mi", want: 16 * GiB},
+		{str: "512Ki", want: 512 * KiB},
+		{str: "17179869184", want: 16 * GiB},
+		{str: " 1Mi ", want: MiB},
+		{str: "0", want: 0},
+		{str: "", err: true},
+		{str: "16G", err: true},
+		{str: "-1Mi", err: true},
+		{str: "1.5Gi", err: true},
+		{str: "18446744073709551615Ki", err: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseQuantity(tt.str)
+		if tt.err {
+			if err == nil {
+				t.Errorf("ParseQuantity(%q) = %v, want error", tt.str, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("ParseQuantity(%q) = %v, %v, want %v", tt.str, got, err, tt.want)
+		}
+		if back, err := ParseQuantity(got.String()); err != nil || back != got {
+			t.Errorf("ParseQuantity(%q) = %v, %v, want %v", got.String(), back, err, got)
+		}
+	}
+}
+
+func TestParseMockMemory(t *testing.T) {
+	tests := []struct {
+		str  string
+		want Quantity
+	}{
+		// a plain number is in MiB rather than in bytes
+		{"16384", 16 * GiB},
+		{"16384Mi", 16 * GiB},
+		{"16Gi", 16 * GiB},
+		{"512Ki", 512 * KiB},
+	}
+	for _, tt := range tests {
+		got, err := parseMockMemory(tt.str)
+		if err != nil || got != tt.want {
+			t.Errorf("parseMockMemory(%q) = %v, %v, want %v", tt.str, got, err, tt.want)
+		}
+	}
+	if _, err := parseMockMemory("16G"); err == nil {
+		t.Errorf("parseMockMemory(%q) succeeded, want error", "16G")
+	}
+}
+
+// TestMemoryUnits checks that a GPU gets the same memory devices whether its
+// memory is reported in bytes by NVML or given in MiB to the mock manager.
+func TestMemoryUnits(t *testing.T) {
+	opts := testOptions()
+	opts.MemoryUnit = 256 * MiB
+	lib := NewFakeNVML(&FakeDevice{
+		UUID:              "GPU-00000000-0000-0000-0000-000000000000",
+		Name:              "Tesla T4",
+		Minor:             0,
+		Memory:            15109 * MiB.Bytes(),
+		PciBusID:          "00000000:01:00.0",
+		NumaNode:          -1,
+		ComputeCapability: [2]int{7, 5},
+	})
+	nvml, err := NewGPUManagerWithNVML(lib, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nvml.Close()
+
+	for _, devs := range []string{"15109", "15109Mi", fmt.Sprintf("%dKi", 15109*1024)} {
+		mock := newTestManager(t, devs, opts)
+		want, err := nvml.GetGPU(0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := mock.GetGPU(0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Memory != want.Memory || got.Advertised != want.Advertised {
+			t.Errorf("mock %q: got memory %v advertising %v, want %v advertising %v", devs, got.Memory, got.Advertised, want.Memory, want.Advertised)
+		}
+		if got, want := ids(mock.GetMemoryDevs()), ids(nvml.GetMemoryDevs()); fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("mock %q: got memory devices %v, want %v", devs, got, want)
+		}
+	}
+	// 15109Mi are 59 devices of 256Mi, the remainder is not advertised
+	if got := len(nvml.GetMemoryDevs()); got != 59 {
+		t.Errorf("got %d memory devices, want 59", got)
+	}
+}
@@ -0,0 +1,231 @@
+/*
+ * Copyright 2022 lbf1353@live.com
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package device
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/NVIDIA/go-nvml/pkg/nvml"
+	"io/ioutil"
+	"k8s.io/klog/v2"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// ErrMigPending is returned when a MIG mode change only applies once the GPU
+// is reset.
+var ErrMigPending = errors.New("mig mode change pending until gpu reset")
+
+// MigConfig is the desired MIG partitioning of the GPUs of a node, e.g.
+//
+//	{"geometries": [
+//	  {"gpus": ["0", "1"], "devices": ["3g.40gb", "2g.20gb", "1g.10gb", "1g.10gb"]},
+//	  {"gpus": ["*A100*"], "devices": []}
+//	]}
+type MigConfig struct {
+	// Geometries are matched in order, the first one selecting a GPU
+	// applies. GPUs selected by none are left as they are.
+	Geometries []MigGeometry `json:"geometries"`
+}
+
+// MigGeometry is the MIG devices of the GPUs it selects.
+type MigGeometry struct {
+	GPUs Selector `json:"gpus"`
+	// Devices are the profiles of the MIG devices, empty disables MIG.
+	Devices []string `json:"devices"`
+}
+
+// LoadMigConfig reads a MigConfig from the JSON file at path.
+func LoadMigConfig(path string) (MigConfig, error) {
+	var config MigConfig
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return config, err
+	}
+	if err := json.Unmarshal(b, &config); err != nil {
+		return config, fmt.Errorf("invalid mig config %s: %v", path, err)
+	}
+	return config, config.Validate()
+}
+
+// Validate checks that all profiles of the config are well-formed.
+func (c MigConfig) Validate() error {
+	for i, g := range c.Geometries {
+		if len(g.GPUs) == 0 {
+			return fmt.Errorf("mig geometry %d selects no gpu", i)
+		}
+		for _, d := range g.Devices {
+			if _, err := ParseMigProfile(d); err != nil {
+				return fmt.Errorf("mig geometry %d: %v", i, err)
+			}
+		}
+	}
+	return nil
+}
+
+// devices returns the sorted MIG profiles desired for gpu, false if the
+// config does not select it.
+func (c MigConfig) devices(gpu GPUInfo) ([]string, bool) {
+	for _, g := range c.Geometries {
+		if g.GPUs.Matches(gpu) {
+			devs := append([]string{}, g.Devices...)
+			sort.Strings(devs)
+			return devs, true
+		}
+	}
+	return nil, false
+}
+
+// MigChange is the repartitioning of one GPU.
+type MigChange struct {
+	Index int
+	// From and To are the sorted MIG profiles of the GPU before and after,
+	// nil when MIG is disabled.
+	From []string
+	To   []string
+	// Pending is set when the MIG mode change awaits a GPU reset. A GPU to
+	// be partitioned keeps MIG disabled and is offered whole until then. A
+	// GPU to be made whole has its MIG devices destroyed before MIG is
+	// disabled, so it keeps MIG enabled without MIG devices and is not
+	// offered at all until then.
+	Pending bool
+}
+
+func (c MigChange) String() string {
+	format := func(profiles []string) string {
+		if profiles == nil {
+			return "mig disabled"
+		}
+		return "[" + strings.Join(profiles, " ") + "]"
+	}
+	str := fmt.Sprintf("gpu %d: %s -> %s", c.Index, format(c.From), format(c.To))
+	if c.Pending {
+		str += " (pending gpu reset)"
+	}
+	return str
+}
+
+// MigReconciler repartitions GPUs into the MIG devices declared by a MigConfig.
+type MigReconciler struct {
+	lib    NVML
+	config MigConfig
+	// DryRun only plans the changes, nothing is applied.
+	DryRun bool
+}
+
+// NewMigReconciler returns a MigReconciler applying config through lib, which
+// must be initialized.
+func NewMigReconciler(lib NVML, config MigConfig, dryRun bool) *MigReconciler {
+	return &MigReconciler{lib: lib, config: config, DryRun: dryRun}
+}
+
+// Plan returns the changes needed for gpus to match the config.
+func (r *MigReconciler) Plan(gpus []GPUInfo) []MigChange {
+	var changes []MigChange
+	for _, gpu := range gpus {
+		want, ok := r.config.devices(gpu)
+		if !ok {
+			continue
+		}
+		var have []string
+		if gpu.MigEnabled {
+			have = []string{}
+			for _, mig := range gpu.MigDevices {
+				have = append(have, mig.Profile)
+			}
+			sort.Strings(have)
+		}
+		if len(want) == 0 {
+			want = nil
+		}
+		if !reflect.DeepEqual(have, want) {
+			changes = append(changes, MigChange{Index: gpu.Index, From: have, To: want})
+		}
+	}
+	return changes
+}
+
+// Reconcile applies the changes needed for gpus to match the config, skipping
+// the GPUs for which inUse returns true. It returns the changes applied, or
+// planned in dry-run mode. A change awaiting a GPU reset is not an error, it is
+// returned as Pending and the other GPUs are reconciled.
+func (r *MigReconciler) Reconcile(gpus []GPUInfo, inUse func(index int) bool) ([]MigChange, error) {
+	var applied []MigChange
+	for _, change := range r.Plan(gpus) {
+		if inUse(change.Index) {
+			klog.InfoS("skip mig reconfiguration of gpu in use", "change", change.String())
+			continue
+		}
+		if r.DryRun {
+			klog.InfoS("would reconfigure mig", "change", change.String())
+			applied = append(applied, change)
+			continue
+		}
+		if err := r.apply(change); errors.Is(err, ErrMigPending) {
+			klog.InfoS("mig mode change pending until gpu reset", "change", change.String(), "err", err)
+			change.Pending = true
+			applied = append(applied, change)
+			continue
+		} else if err != nil {
+			return applied, fmt.Errorf("reconfigure mig of gpu %d: %w", change.Index, err)
+		}
+		klog.InfoS("reconfigured mig", "change", change.String())
+		applied = append(applied, change)
+	}
+	return applied, nil
+}
+
+func (r *MigReconciler) apply(change MigChange) error {
+	dev, err := r.lib.DeviceByIndex(change.Index)
+	if err != nil {
+		return err
+	}
+
+	if change.From != nil {
+		if err := dev.DestroyMigDevices(); err != nil {
+			return err
+		}
+	}
+	if change.To == nil {
+		return dev.SetMigMode(nvml.DEVICE_MIG_DISABLE)
+	}
+	if change.From == nil {
+		if err := dev.SetMigMode(nvml.DEVICE_MIG_ENABLE); err != nil {
+			return err
+		}
+	}
+	// Larger instances first, smaller ones fill the remaining slices.
+	profiles := make([]MigProfile, 0, len(change.To))
+	for _, str := range change.To {
+		p, err := ParseMigProfile(str)
+		if err != nil {
+			return err
+		}
+		profiles = append(profiles, p)
+	}
+	sort.SliceStable(profiles, func(i, j int) bool {
+		return profiles[i].GpuSlices > profiles[j].GpuSlices
+	})
+	for _, p := range profiles {
+		if err := dev.CreateMigDevice(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,179 @@
+/*
+ * Copyright 2022 lbf1353@live.com
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package device
+
+import (
+	"fmt"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+	"reflect"
+	"testing"
+)
+
+// newMigTestManager returns a manager of three fake A100 GPUs, the first one
+// partitioned in 3g.20gb and 1g.5gb, along with the fakes.
+func newMigTestManager(t *testing.T) (*GPUManager, []*FakeDevice) {
+	t.Helper()
+	var fakes []*FakeDevice
+	for i := 0; i < 3; i++ {
+		fakes = append(fakes, &FakeDevice{
+			UUID:     fmt.Sprintf("GPU-%d", i),
+			Name:     "NVIDIA A100-SXM4-40GB",
+			Minor:    i,
+			Memory:   (40 * GiB).Bytes(),
+			NumaNode: -1,
+		})
+	}
+	if err := SetFakeMigDevices(fakes[0], "3g.20gb", "1g.5gb"); err != nil {
+		t.Fatal(err)
+	}
+	m, err := NewGPUManagerWithNVML(NewFakeNVML(fakes...), testOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { m.Close() })
+	return m, fakes
+}
+
+// testMigConfig disables MIG on gpu 0 and partitions gpu 1 and 2.
+var testMigConfig = MigConfig{Geometries: []MigGeometry{
+	{GPUs: Selector{"0"}, Devices: []string{}},
+	{GPUs: Selector{"*A100*"}, Devices: []string{"1g.5gb", "3g.20gb", "1g.5gb"}},
+}}
+
+func notInUse(int) bool { return false }
+
+func TestMigReconcilerPlan(t *testing.T) {
+	m, _ := newMigTestManager(t)
+	want := []MigChange{
+		{Index: 0, From: []string{"1g.5gb", "3g.20gb"}},
+		{Index: 1, To: []string{"1g.5gb", "1g.5gb", "3g.20gb"}},
+		{Index: 2, To: []string{"1g.5gb", "1g.5gb", "3g.20gb"}},
+	}
+	if got := NewMigReconciler(m.lib, testMigConfig, false).Plan(m.GetGPUs()); !reflect.DeepEqual(got, want) {
+		t.Errorf("Plan = %v, want %v", got, want)
+	}
+}
+
+func TestMigReconcilerDryRun(t *testing.T) {
+	m, _ := newMigTestManager(t)
+	changes, err := m.ReconcileMig(testMigConfig, true, func(index int) bool { return index == 2 })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 2 || changes[0].Index != 0 || changes[1].Index != 1 {
+		t.Errorf("ReconcileMig = %v, want the changes of gpu 0 and 1", changes)
+	}
+	if got := m.GetMigProfiles(); !reflect.DeepEqual(got, []string{"1g.5gb", "3g.20gb"}) {
+		t.Errorf("dry run changed the mig profiles to %v", got)
+	}
+}
+
+func TestMigReconcilerReconcile(t *testing.T) {
+	m, _ := newMigTestManager(t)
+	m.SetHealth(1, pluginapi.Unhealthy)
+
+	changes, err := m.ReconcileMig(testMigConfig, false, notInUse)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 3 {
+		t.Errorf("ReconcileMig = %v, want 3 changes", changes)
+	}
+	if plan := NewMigReconciler(m.lib, testMigConfig, false).Plan(m.GetGPUs()); len(plan) != 0 {
+		t.Errorf("still planned after reconcile: %v", plan)
+	}
+
+	if got := len(m.GetGPUDevs()); got != 1 {
+		t.Errorf("got %d gpu devices, want gpu 0 only", got)
+	}
+	for _, dev := range m.GetMigDevs("1g.5gb") {
+		mig, err := m.ParseMigDevID(dev.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := map[int]string{1: pluginapi.Unhealthy, 2: pluginapi.Healthy}[mig.Parent]; dev.Health != want {
+			t.Errorf("mig device %s of gpu %d is %s, want %s", dev.ID, mig.Parent, dev.Health, want)
+		}
+	}
+}
+
+func TestMigReconcilerPending(t *testing.T) {
+	m, fakes := newMigTestManager(t)
+	fakes[1].ResetRequired = true
+
+	changes, err := m.ReconcileMig(testMigConfig, false, notInUse)
+	if err != nil {
+		t.Fatalf("ReconcileMig: %v", err)
+	}
+	var pending []int
+	for _, change := range changes {
+		if change.Pending {
+			pending = append(pending, change.Index)
+		}
+	}
+	if !reflect.DeepEqual(pending, []int{1}) {
+		t.Errorf("pending changes of gpus %v, want [1]", pending)
+	}
+
+	gpu, err := m.GetGPU(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gpu.MigEnabled {
+		t.Errorf("gpu 1 has mig enabled before reset")
+	}
+	if gpu, _ := m.GetGPU(2); len(gpu.MigDevices) != 3 {
+		t.Errorf("gpu 2 has %d mig devices, want 3", len(gpu.MigDevices))
+	}
+}
+
+func TestMigReconcilerPendingDisable(t *testing.T) {
+	m, fakes := newMigTestManager(t)
+	fakes[0].ResetRequired = true
+
+	changes, err := m.ReconcileMig(testMigConfig, false, notInUse)
+	if err != nil {
+		t.Fatalf("ReconcileMig: %v", err)
+	}
+	if len(changes) != 3 || changes[0].Index != 0 || !changes[0].Pending || changes[1].Pending || changes[2].Pending {
+		t.Errorf("ReconcileMig = %v, want the change of gpu 0 pending only", changes)
+	}
+
+	// the mig devices are gone but mig stays enabled until the reset
+	gpu, err := m.GetGPU(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !gpu.MigEnabled || len(gpu.MigDevices) != 0 {
+		t.Errorf("gpu 0 has mig enabled %v with %d mig devices, want enabled without devices", gpu.MigEnabled, len(gpu.MigDevices))
+	}
+	for _, dev := range m.GetGPUDevs() {
+		if dev.ID == "GPU-0" {
+			t.Errorf("gpu 0 is offered before reset")
+		}
+	}
+	if n := len(m.GetMemoryDevsOf(0)) + len(m.GetCoreDevsOf(0)); n != 0 {
+		t.Errorf("gpu 0 is offered as %d memory and core devices before reset", n)
+	}
+	for _, profile := range m.GetMigProfiles() {
+		for _, dev := range m.GetMigDevs(profile) {
+			if mig, _ := m.ParseMigDevID(dev.ID); mig.Parent == 0 {
+				t.Errorf("mig device %s of gpu 0 is offered before reset", dev.ID)
+			}
+		}
+	}
+}
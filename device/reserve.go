@@ -0,0 +1,98 @@
+/*
+ * Copyright 2022 lbf1353@live.com
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package device
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Reservation is an amount of GPU memory kept out of the memory devices,
+// either absolute or as a percentage of the GPU memory.
+type Reservation struct {
+	// Memory is the absolute reservation.
+	Memory Quantity
+	// Percent is the reservation relative to the GPU memory, used when
+	// Memory is zero.
+	Percent float64
+}
+
+// Validate checks that the reservation is within bounds.
+func (r Reservation) Validate() error {
+	if r.Percent < 0 || r.Percent > 100 {
+		return fmt.Errorf("reserved memory percentage must be between 0 and 100, got %v", r.Percent)
+	}
+	return nil
+}
+
+// Of returns the reserved memory of a GPU with total memory, never more than
+// total.
+func (r Reservation) Of(total Quantity) Quantity {
+	reserved := r.Memory
+	if reserved == 0 {
+		reserved = Quantity(float64(total) * r.Percent / 100)
+	}
+	if reserved > total {
+		return total
+	}
+	return reserved
+}
+
+// ParseReservation parses a memory reservation such as "512Mi", "1Gi" or
+// "10%". An empty string reserves nothing.
+func ParseReservation(str string) (Reservation, error) {
+	str = strings.TrimSpace(str)
+	if len(str) == 0 || str == "0" {
+		return Reservation{}, nil
+	}
+	if strings.HasSuffix(str, "%") {
+		pct, err := strconv.ParseFloat(strings.TrimSuffix(str, "%"), 64)
+		if err != nil {
+			return Reservation{}, fmt.Errorf("invalid reserved memory %q: %v", str, err)
+		}
+		r := Reservation{Percent: pct}
+		return r, r.Validate()
+	}
+	mem, err := ParseQuantity(str)
+	if err != nil {
+		return Reservation{}, fmt.Errorf("invalid reserved memory: %v", err)
+	}
+	return Reservation{Memory: mem}, nil
+}
+
+// ParseModelReservations parses comma separated <model>=<reservation> pairs,
+// e.g. "Tesla T4=512Mi,NVIDIA A100-SXM4-40GB=5%", keyed by GPU product name.
+func ParseModelReservations(str string) (map[string]Reservation, error) {
+	res := make(map[string]Reservation)
+	for _, s := range strings.Split(str, ",") {
+		if len(strings.TrimSpace(s)) == 0 {
+			continue
+		}
+		kv := strings.SplitN(s, "=", 2)
+		model := strings.TrimSpace(kv[0])
+		if len(kv) != 2 || len(model) == 0 {
+			return nil, fmt.Errorf("invalid per model reserved memory %q: must be <model>=<reservation>", s)
+		}
+		r, err := ParseReservation(kv[1])
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", model, err)
+		}
+		res[model] = r
+	}
+	return res, nil
+}
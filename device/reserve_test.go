@@ -0,0 +1,111 @@
+/*
+ * Copyright 2022 lbf1353@live.com
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package device
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestParseReservation(t *testing.T) {
+	tests := []struct {
+		str  string
+		want Reservation
+		err  bool
+	}{
+		{str: "", want: Reservation{}},
+		{str: "0", want: Reservation{}},
+		{str: "512Mi", want: Reservation{Memory: 512 * MiB}},
+		{str: " 1Gi ", want: Reservation{Memory: GiB}},
+		{str: "10%", want: Reservation{Percent: 10}},
+		{str: "12.5%", want: Reservation{Percent: 12.5}},
+		{str: "0%", want: Reservation{}},
+		{str: "100%", want: Reservation{Percent: 100}},
+		{str: "101%", err: true},
+		{str: "-1%", err: true},
+		{str: "ten%", err: true},
+		{str: "1G", err: true},
+		{str: "-512Mi", err: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseReservation(tt.str)
+		if tt.err {
+			if err == nil {
+				t.Errorf("ParseReservation(%q) = %+v, want error", tt.str, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("ParseReservation(%q) = %+v, %v, want %+v", tt.str, got, err, tt.want)
+		}
+	}
+}
+
+func TestParseModelReservations(t *testing.T) {
+	tests := []struct {
+		str  string
+		want map[string]Reservation
+		err  bool
+	}{
+		{str: "", want: map[string]Reservation{}},
+		{
+			str: "Tesla T4=512Mi, NVIDIA A100-SXM4-40GB=5%,",
+			want: map[string]Reservation{
+				"Tesla T4":              {Memory: 512 * MiB},
+				"NVIDIA A100-SXM4-40GB": {Percent: 5},
+			},
+		},
+		{str: "Tesla T4", err: true},
+		{str: "=512Mi", err: true},
+		{str: "Tesla T4=101%", err: true},
+		{str: "Tesla T4=512M", err: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseModelReservations(tt.str)
+		if tt.err {
+			if err == nil {
+				t.Errorf("ParseModelReservations(%q) = %v, want error", tt.str, got)
+			}
+			continue
+		}
+		if err != nil || fmt.Sprint(got) != fmt.Sprint(tt.want) {
+			t.Errorf("ParseModelReservations(%q) = %v, %v, want %v", tt.str, got, err, tt.want)
+		}
+	}
+}
+
+func TestReservationOf(t *testing.T) {
+	tests := []struct {
+		r     Reservation
+		total Quantity
+		want  Quantity
+	}{
+		{Reservation{}, 16 * GiB, 0},
+		{Reservation{Memory: 512 * MiB}, 16 * GiB, 512 * MiB},
+		{Reservation{Percent: 10}, 40 * GiB, 4 * GiB},
+		{Reservation{Percent: 100}, 16 * GiB, 16 * GiB},
+		// capped at the memory of the gpu
+		{Reservation{Memory: 32 * GiB}, 16 * GiB, 16 * GiB},
+		// the absolute reservation wins
+		{Reservation{Memory: GiB, Percent: 50}, 16 * GiB, GiB},
+	}
+	for _, tt := range tests {
+		if got := tt.r.Of(tt.total); got != tt.want {
+			t.Errorf("%+v.Of(%v) = %v, want %v", tt.r, tt.total, got, tt.want)
+		}
+	}
+}
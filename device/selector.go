@@ -0,0 +1,95 @@
+/*
+ * Copyright 2022 lbf1353@live.com
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package device
+
+import (
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// Selector selects GPUs by index, UUID, PCI bus ID or product name glob. The
+// kind of each entry is told by its format: a number is an index, GPU-<uuid>
+// a UUID, <domain>:<bus>:<device>.<function> a PCI bus ID, anything else a
+// glob matched against the product name, e.g. "Tesla T4" or "*A100*".
+type Selector []string
+
+// ParseSelector parses a comma separated list of Selector entries.
+func ParseSelector(str string) (Selector, error) {
+	var sel Selector
+	for _, s := range strings.Split(str, ",") {
+		s = strings.TrimSpace(s)
+		if len(s) == 0 {
+			continue
+		}
+		if _, err := path.Match(s, ""); err != nil {
+			return nil, fmt.Errorf("invalid gpu selector %q: %v", s, err)
+		}
+		sel = append(sel, s)
+	}
+	return sel, nil
+}
+
+// Matches reports whether any entry of the selector matches gpu.
+func (sel Selector) Matches(gpu GPUInfo) bool {
+	for _, s := range sel {
+		if matchGPU(s, gpu) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchGPU(s string, gpu GPUInfo) bool {
+	if idx, err := strconv.Atoi(s); err == nil {
+		return idx == gpu.Index
+	}
+	if strings.HasPrefix(s, GPUDevPrefix+"-") {
+		return s == gpu.UUID
+	}
+	if strings.Count(s, ":") == 2 {
+		return normalizePciBusID(s) == normalizePciBusID(gpu.PciBusID)
+	}
+	ok, _ := path.Match(s, gpu.Name)
+	return ok
+}
+
+// normalizePciBusID returns a PCI bus ID in lower case with a 4 digit domain,
+// NVML reports 8 digits while lspci and sysfs use 4.
+func normalizePciBusID(id string) string {
+	id = strings.ToLower(id)
+	if len(id) > 12 {
+		id = id[len(id)-12:]
+	}
+	return id
+}
+
+// Filter selects the GPUs advertised by a manager. A GPU is advertised if it
+// matches Include, or Include is empty, and it does not match Exclude.
+type Filter struct {
+	Include Selector
+	Exclude Selector
+}
+
+// Allows reports whether gpu passes the filter.
+func (f Filter) Allows(gpu GPUInfo) bool {
+	if len(f.Include) != 0 && !f.Include.Matches(gpu) {
+		return false
+	}
+	return !f.Exclude.Matches(gpu)
+}
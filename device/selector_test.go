@@ -0,0 +1,108 @@
+/*
+ * Copyright 2022 lbf1353@live.com
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package device
+
+import (
+	"fmt"
+	"testing"
+)
+
+// selectorGPUs are the gpus matched by the selector tests.
+var selectorGPUs = []GPUInfo{
+	{Index: 0, UUID: "GPU-1d8a1b5c-0000-0000-0000-000000000000", Name: "Tesla T4", PciBusID: "00000000:1A:00.0"},
+	{Index: 1, UUID: "GPU-7f3e9c21-0000-0000-0000-000000000000", Name: "NVIDIA A100-SXM4-40GB", PciBusID: "00000000:3B:00.0"},
+	{Index: 2, UUID: "GPU-c04b2e8d-0000-0000-0000-000000000000", Name: "NVIDIA A100-SXM4-80GB", PciBusID: "00000001:AF:00.0"},
+}
+
+// selected returns the indexes of the selectorGPUs for which match is true.
+func selected(match func(GPUInfo) bool) []int {
+	var indexes []int
+	for _, gpu := range selectorGPUs {
+		if match(gpu) {
+			indexes = append(indexes, gpu.Index)
+		}
+	}
+	return indexes
+}
+
+func TestSelectorMatches(t *testing.T) {
+	tests := []struct {
+		sel  string
+		want []int
+	}{
+		{"1", []int{1}},
+		{"0,2", []int{0, 2}},
+		{"3", nil},
+		{"GPU-7f3e9c21-0000-0000-0000-000000000000", []int{1}},
+		{"GPU-7f3e9c21", nil},
+		// nvml reports an 8 digit domain, lspci a 4 digit one
+		{"00000000:1A:00.0", []int{0}},
+		{"0000:1a:00.0", []int{0}},
+		{"0001:AF:00.0", []int{2}},
+		{"0000:AF:00.0", nil},
+		{"Tesla T4", []int{0}},
+		{"*A100*", []int{1, 2}},
+		{"NVIDIA A100-SXM4-??GB", []int{1, 2}},
+		{"*80GB, 0", []int{0, 2}},
+		{"A100", nil},
+		{"", nil},
+	}
+	for _, tt := range tests {
+		sel, err := ParseSelector(tt.sel)
+		if err != nil {
+			t.Errorf("ParseSelector(%q): %v", tt.sel, err)
+			continue
+		}
+		if got := selected(sel.Matches); fmt.Sprint(got) != fmt.Sprint(tt.want) {
+			t.Errorf("selector %q matches %v, want %v", tt.sel, got, tt.want)
+		}
+	}
+
+	if _, err := ParseSelector("Tesla[T4"); err == nil {
+		t.Errorf("ParseSelector(%q) succeeded, want error", "Tesla[T4")
+	}
+}
+
+func TestFilterAllows(t *testing.T) {
+	tests := []struct {
+		include string
+		exclude string
+		want    []int
+	}{
+		{"", "", []int{0, 1, 2}},
+		{"*A100*", "", []int{1, 2}},
+		{"", "*A100*", []int{0}},
+		// exclude wins over include
+		{"*A100*", "*80GB", []int{1}},
+		{"1", "*A100*", nil},
+		{"0", "1", []int{0}},
+	}
+	for _, tt := range tests {
+		include, err := ParseSelector(tt.include)
+		if err != nil {
+			t.Fatal(err)
+		}
+		exclude, err := ParseSelector(tt.exclude)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f := Filter{Include: include, Exclude: exclude}
+		if got := selected(f.Allows); fmt.Sprint(got) != fmt.Sprint(tt.want) {
+			t.Errorf("include %q and exclude %q allow %v, want %v", tt.include, tt.exclude, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,224 @@
+/*
+ * Copyright 2022 lbf1353@live.com
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package device
+
+import (
+	"fmt"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+	"sync"
+)
+
+// subsetManager is a Manager restricted to the GPUs of another Manager which
+// match a predicate. Device IDs of other GPUs are rejected as unknown.
+type subsetManager struct {
+	Manager
+	match func(GPUInfo) bool
+
+	memoryDevs devsCache
+	coreDevs   devsCache
+}
+
+// devsCache holds a device list of a subset built out of a device list of the
+// underlying Manager, which hands out the same list until it changes.
+type devsCache struct {
+	mu   sync.Mutex
+	from []*pluginapi.Device
+	devs []*pluginapi.Device
+}
+
+// get returns the cached list if it was built out of from, the list returned
+// by build otherwise.
+func (c *devsCache) get(from []*pluginapi.Device, build func() []*pluginapi.Device) []*pluginapi.Device {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(from) == 0 || len(c.from) != len(from) || &c.from[0] != &from[0] {
+		c.from = from
+		c.devs = build()
+	}
+	return c.devs
+}
+
+var _ Manager = &subsetManager{}
+
+// NewSubsetManager returns a view of m restricted to the GPUs for which match
+// returns true. Health changes and notifications go through m, and closing the
+// view does not close m.
+func NewSubsetManager(m Manager, match func(GPUInfo) bool) Manager {
+	return &subsetManager{Manager: m, match: match}
+}
+
+// contains reports whether the GPU at index is part of the subset.
+func (s *subsetManager) contains(index int) bool {
+	gpu, err := s.Manager.GetGPU(index)
+	return err == nil && s.match(gpu)
+}
+
+// indexes returns the indexes of the GPUs of the subset.
+func (s *subsetManager) indexes() map[int]struct{} {
+	set := make(map[int]struct{})
+	for _, gpu := range s.GetGPUs() {
+		set[gpu.Index] = struct{}{}
+	}
+	return set
+}
+
+func (s *subsetManager) GetMemoryDevs() []*pluginapi.Device {
+	return s.memoryDevs.get(s.Manager.GetMemoryDevs(), func() []*pluginapi.Device {
+		var devs []*pluginapi.Device
+		for _, gpu := range s.GetGPUs() {
+			devs = append(devs, s.Manager.GetMemoryDevsOf(gpu.Index)...)
+		}
+		return devs
+	})
+}
+
+func (s *subsetManager) GetMemoryDevsOf(index int) []*pluginapi.Device {
+	if !s.contains(index) {
+		return nil
+	}
+	return s.Manager.GetMemoryDevsOf(index)
+}
+
+func (s *subsetManager) GetCoreDevs() []*pluginapi.Device {
+	return s.coreDevs.get(s.Manager.GetCoreDevs(), func() []*pluginapi.Device {
+		var devs []*pluginapi.Device
+		for _, gpu := range s.GetGPUs() {
+			devs = append(devs, s.Manager.GetCoreDevsOf(gpu.Index)...)
+		}
+		return devs
+	})
+}
+
+func (s *subsetManager) GetCoreDevsOf(index int) []*pluginapi.Device {
+	if !s.contains(index) {
+		return nil
+	}
+	return s.Manager.GetCoreDevsOf(index)
+}
+
+func (s *subsetManager) GetGPUDevs() []*pluginapi.Device {
+	set := s.indexes()
+	var devs []*pluginapi.Device
+	for _, dev := range s.Manager.GetGPUDevs() {
+		if idx, err := s.Manager.ParseGPUDevID(dev.ID); err == nil {
+			if _, ok := set[idx]; ok {
+				devs = append(devs, dev)
+			}
+		}
+	}
+	return devs
+}
+
+func (s *subsetManager) GetGPUs() []GPUInfo {
+	var infos []GPUInfo
+	for _, gpu := range s.Manager.GetGPUs() {
+		if s.match(gpu) {
+			infos = append(infos, gpu)
+		}
+	}
+	return infos
+}
+
+func (s *subsetManager) GetGPU(index int) (GPUInfo, error) {
+	gpu, err := s.Manager.GetGPU(index)
+	if err != nil {
+		return GPUInfo{}, err
+	}
+	if !s.match(gpu) {
+		return GPUInfo{}, fmt.Errorf("unknown gpu index: %d", index)
+	}
+	return gpu, nil
+}
+
+func (s *subsetManager) ParseGPUDevID(id string) (int, error) {
+	idx, err := s.Manager.ParseGPUDevID(id)
+	if err != nil {
+		return 0, err
+	}
+	if !s.contains(idx) {
+		return 0, fmt.Errorf("unknown gpu: %s", id)
+	}
+	return idx, nil
+}
+
+func (s *subsetManager) ParseMemoryDevID(id string) (int, int, error) {
+	idx, slice, err := s.Manager.ParseMemoryDevID(id)
+	if err != nil {
+		return 0, 0, err
+	}
+	if !s.contains(idx) {
+		return 0, 0, fmt.Errorf("unknown gpu: %s", id)
+	}
+	return idx, slice, nil
+}
+
+func (s *subsetManager) ParseCoreDevID(id string) (int, int, error) {
+	idx, percent, err := s.Manager.ParseCoreDevID(id)
+	if err != nil {
+		return 0, 0, err
+	}
+	if !s.contains(idx) {
+		return 0, 0, fmt.Errorf("unknown gpu: %s", id)
+	}
+	return idx, percent, nil
+}
+
+func (s *subsetManager) GetMigProfiles() []string {
+	set := make(map[string]struct{})
+	for _, gpu := range s.GetGPUs() {
+		for _, mig := range gpu.MigDevices {
+			set[mig.Profile] = struct{}{}
+		}
+	}
+	var profiles []string
+	for _, profile := range s.Manager.GetMigProfiles() {
+		if _, ok := set[profile]; ok {
+			profiles = append(profiles, profile)
+		}
+	}
+	return profiles
+}
+
+func (s *subsetManager) GetMigDevs(profile string) []*pluginapi.Device {
+	set := s.indexes()
+	var devs []*pluginapi.Device
+	for _, dev := range s.Manager.GetMigDevs(profile) {
+		if mig, err := s.Manager.ParseMigDevID(dev.ID); err == nil {
+			if _, ok := set[mig.Parent]; ok {
+				devs = append(devs, dev)
+			}
+		}
+	}
+	return devs
+}
+
+func (s *subsetManager) ParseMigDevID(id string) (MigInfo, error) {
+	mig, err := s.Manager.ParseMigDevID(id)
+	if err != nil {
+		return MigInfo{}, err
+	}
+	if !s.contains(mig.Parent) {
+		return MigInfo{}, fmt.Errorf("unknown mig device: %s", id)
+	}
+	return mig, nil
+}
+
+// Close is a no-op, the underlying Manager is owned by the caller.
+func (s *subsetManager) Close() error {
+	return nil
+}
@@ -3,14 +3,15 @@ module github.com/WLBF/flex-gpu-device-plugin
 go 1.17
 
 require (
+	github.com/NVIDIA/go-nvml v0.11.6-0
 	github.com/fsnotify/fsnotify v1.5.1
 	golang.org/x/net v0.0.0-20220114011407-0dd24b26b47d
 	google.golang.org/grpc v1.43.0
+	k8s.io/klog/v2 v2.70.1
 	k8s.io/kubelet v0.23.1
 )
 
 require (
-	github.com/NVIDIA/go-nvml v0.11.6-0 // indirect
 	github.com/go-logr/logr v1.2.0 // indirect
 	github.com/gogo/protobuf v1.3.2 // indirect
 	github.com/golang/protobuf v1.5.2 // indirect
@@ -18,5 +19,4 @@ require (
 	golang.org/x/text v0.3.7 // indirect
 	google.golang.org/genproto v0.0.0-20210831024726-fe130286e0e2 // indirect
 	google.golang.org/protobuf v1.27.1 // indirect
-	k8s.io/klog/v2 v2.70.1 // indirect
 )
@@ -0,0 +1,200 @@
+/*
+ * Copyright 2022 lbf1353@live.com
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package plugin
+
+import (
+	"github.com/WLBF/flex-gpu-device-plugin/device"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2"
+	"log"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/context"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+const (
+	CoreResourceName = "nvidia.flex.com/core"
+	CoreSockName     = "flex-nvidia-gpu-core.sock"
+)
+
+var _ DevicePlugin = &CoreDevicePlugin{}
+
+// CoreDevicePlugin implements the Kubernetes device plugin API
+type CoreDevicePlugin struct {
+	pluginServer
+
+	manager  device.Manager
+	ledger   *device.Ledger
+	policy   device.Policy
+	strategy string
+	// podResources is the socket of the kubelet pod resources API.
+	podResources string
+}
+
+// NewCoreDevicePlugin returns an initialized CoreDevicePlugin
+func NewCoreDevicePlugin(path string, manager device.Manager, ledger *device.Ledger, policy device.Policy, strategy string) *CoreDevicePlugin {
+	m := &CoreDevicePlugin{
+		manager:      manager,
+		ledger:       ledger,
+		policy:       policy,
+		strategy:     strategy,
+		podResources: PodResourcesSocket,
+	}
+	m.pluginServer = newPluginServer(CoreResourceName, filepath.Join(path, CoreSockName), true, m)
+	m.preStartRequired = true
+	return m
+}
+
+// NewModelCoreDevicePlugin returns a CoreDevicePlugin for the GPUs of one
+// model, whose resource name is nvidia.flex.com/<model>-core.
+func NewModelCoreDevicePlugin(path string, model string, manager device.Manager, ledger *device.Ledger, policy device.Policy, strategy string) *CoreDevicePlugin {
+	m := NewCoreDevicePlugin(path, manager, ledger, policy, strategy)
+	m.resourceName = ResourceDomain + model + "-core"
+	m.socket = filepath.Join(path, "flex-nvidia-gpu-"+model+"-core.sock")
+	return m
+}
+
+// ListAndWatch lists devices and update that list according to the health status
+func (m *CoreDevicePlugin) ListAndWatch(e *pluginapi.Empty, s pluginapi.DevicePlugin_ListAndWatchServer) error {
+	stop := m.stop
+	updates, cancel := m.manager.Subscribe()
+	defer cancel()
+	ledgerUpdates, cancelLedger := m.ledger.Subscribe()
+	defer cancelLedger()
+
+	var last []*pluginapi.Device
+	sent := false
+	for {
+		devices := m.devices()
+		if !sent || !devicesEqual(last, devices) {
+			klog.V(6).InfoS("core size", "size", len(devices))
+			if err := s.Send(&pluginapi.ListAndWatchResponse{Devices: devices}); err != nil {
+				return err
+			}
+			last = devices
+			sent = true
+		}
+
+		select {
+		case <-s.Context().Done():
+			return nil
+		case <-stop:
+			return nil
+		case <-updates:
+		case <-ledgerUpdates:
+		}
+	}
+}
+
+// devices returns the core devices of the manager, with the ones of
+// exclusively allocated GPUs reported unhealthy.
+func (m *CoreDevicePlugin) devices() []*pluginapi.Device {
+	return withExclusiveUnhealthy(m.manager, m.ledger, m.manager.GetCoreDevs(), m.manager.GetCoreDevsOf)
+}
+
+// GetPreferredAllocation returns the preferred allocation from the set of devices specified in the request
+func (m *CoreDevicePlugin) GetPreferredAllocation(ctx context.Context, r *pluginapi.PreferredAllocationRequest) (*pluginapi.PreferredAllocationResponse, error) {
+	response := &pluginapi.PreferredAllocationResponse{}
+	for _, req := range r.ContainerRequests {
+		prefer := colocationHint(m.ledger, m.manager.IsMemoryDev)
+		devs, err := device.PreferredCoreDevs(m.manager, m.policy, req.AvailableDeviceIDs, req.MustIncludeDeviceIDs, int(req.AllocationSize), prefer)
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid preferred allocation request for '%s': %v", m.resourceName, err)
+		}
+		klog.V(6).InfoS("preferred core allocation", "size", req.AllocationSize, "devices", devs)
+
+		response.ContainerResponses = append(response.ContainerResponses, &pluginapi.ContainerPreferredAllocationResponse{
+			DeviceIDs: devs,
+		})
+	}
+	return response, nil
+}
+
+// Allocate which return list of devices.
+func (m *CoreDevicePlugin) Allocate(ctx context.Context, reqs *pluginapi.AllocateRequest) (*pluginapi.AllocateResponse, error) {
+	owners, err := claimShared(m.manager, m.ledger, m.resourceName, reqs, device.ValidateCoreAllocation)
+	if err != nil {
+		return nil, err
+	}
+
+	responses := &pluginapi.AllocateResponse{}
+	for i, req := range reqs.ContainerRequests {
+		gpus := owners[i : i+1]
+		klog.V(6).InfoS("allocate core", "gpu", gpus[0].Index, "percent", len(req.DevicesIDs))
+
+		percent := strconv.Itoa(len(req.DevicesIDs))
+		envs := map[string]string{
+			VisibleDevicesEnv:      visibleDevices(m.strategy, gpus),
+			CoreLimitEnv:           percent,
+			MPSThreadPercentageEnv: percent,
+		}
+
+		// return empty ContainerAllocateResponse will cause kubelet error
+		responses.ContainerResponses = append(responses.ContainerResponses, &pluginapi.ContainerAllocateResponse{
+			Envs:        envs,
+			Mounts:      []*pluginapi.Mount{},
+			Devices:     deviceSpecs(gpus),
+			Annotations: map[string]string{},
+		})
+	}
+	return responses, nil
+}
+
+// PreStartContainer refuses to start a container whose cores and memory were
+// allocated on different GPUs. Kubelet allocates them independently and only
+// prefers the GPU of one for the other, while a container gets a single GPU
+// through NVIDIA_VISIBLE_DEVICES whose limits would not be the granted ones.
+// The container is let through if kubelet can not be asked.
+func (m *CoreDevicePlugin) PreStartContainer(ctx context.Context, req *pluginapi.PreStartContainerRequest) (*pluginapi.PreStartContainerResponse, error) {
+	if len(req.DevicesIDs) == 0 {
+		return &pluginapi.PreStartContainerResponse{}, nil
+	}
+	idx, _, err := m.manager.ParseCoreDevID(req.DevicesIDs[0])
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid pre start request for '%s': %v", m.resourceName, err)
+	}
+
+	pod, container, err := findContainer(m.podResources, m.resourceName, req.DevicesIDs[0])
+	if err != nil {
+		log.Printf("Could not check that the cores of gpu %d share the gpu with the memory of their container: %v", idx, err)
+		return &pluginapi.PreStartContainerResponse{}, nil
+	}
+	if container == nil {
+		klog.V(4).InfoS("no container holds the cores", "gpu", idx, "id", req.DevicesIDs[0])
+		return &pluginapi.PreStartContainerResponse{}, nil
+	}
+	for _, devs := range container.Devices {
+		if !strings.HasPrefix(devs.ResourceName, ResourceDomain) {
+			continue
+		}
+		for _, id := range devs.DeviceIds {
+			if !strings.HasPrefix(id, device.MemoryDevPrefix+"-") {
+				continue
+			}
+			if memIdx, _, err := m.manager.ParseMemoryDevID(id); err != nil || memIdx != idx {
+				return nil, status.Errorf(codes.FailedPrecondition,
+					"container %s of pod %s/%s got '%s' of gpu %d and '%s' device %s of another gpu, request both only on nodes with a single shared gpu",
+					container.Name, pod.Namespace, pod.Name, m.resourceName, idx, devs.ResourceName, id)
+			}
+		}
+	}
+	return &pluginapi.PreStartContainerResponse{}, nil
+}
@@ -0,0 +1,190 @@
+/*
+ * Copyright 2022 lbf1353@live.com
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package plugin
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/WLBF/flex-gpu-device-plugin/device"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+// deviceIDs returns the IDs of devs.
+func deviceIDs(devs []*pluginapi.Device) []string {
+	var ids []string
+	for _, dev := range devs {
+		ids = append(ids, dev.ID)
+	}
+	return ids
+}
+
+// coreIDs returns the IDs of the cores from to to of the GPU at index.
+func coreIDs(index, from, to int) []string {
+	var ids []string
+	for j := from; j < to; j++ {
+		ids = append(ids, fmt.Sprintf("CORE-%d-%d", index, j))
+	}
+	return ids
+}
+
+func TestCoreAllocate(t *testing.T) {
+	m := newTestManager(t, "2Gi,2Gi", testOptions(device.DeviceIDIndex))
+	ledger := device.NewLedger()
+	p := NewCoreDevicePlugin(t.TempDir(), m, ledger, device.BinpackPolicy{}, VisibleDevicesIndex)
+
+	resp, err := p.Allocate(context.Background(), allocateRequest(coreIDs(1, 0, 30), coreIDs(1, 50, 100)))
+	if err != nil {
+		t.Fatalf("Allocate: %v", err)
+	}
+	for i, want := range []string{"30", "50"} {
+		envs := resp.ContainerResponses[i].Envs
+		if envs[VisibleDevicesEnv] != "1" || envs[CoreLimitEnv] != want || envs[MPSThreadPercentageEnv] != want {
+			t.Errorf("container %d: got envs %v, want gpu 1 limited to %s percent", i, envs, want)
+		}
+	}
+	if ledger.IsShared(0) || !ledger.IsShared(1) {
+		t.Errorf("got gpu 0 and 1 shared %v %v, want gpu 1 only", ledger.IsShared(0), ledger.IsShared(1))
+	}
+
+	tests := []struct {
+		name string
+		ids  []string
+	}{
+		{"across gpus", append(coreIDs(0, 0, 10), coreIDs(1, 0, 10)...)},
+		{"unknown core", []string{"CORE-0-100"}},
+		{"memory device", []string{"MEM-0-0"}},
+	}
+	for _, tt := range tests {
+		_, err := p.Allocate(context.Background(), allocateRequest(coreIDs(0, 0, 10), tt.ids))
+		if status.Code(err) != codes.InvalidArgument {
+			t.Errorf("%s: got error %v, want %v", tt.name, err, codes.InvalidArgument)
+		}
+	}
+	if ledger.IsShared(0) {
+		t.Errorf("rejected allocations left gpu 0 claimed")
+	}
+
+	if err := ledger.ClaimExclusive([]int{1}); err == nil {
+		t.Errorf("gpu 1 with cores allocated claimed exclusively")
+	}
+}
+
+func TestCoreAllocateExclusive(t *testing.T) {
+	m := newTestManager(t, "2Gi,2Gi", testOptions(device.DeviceIDIndex))
+	ledger := device.NewLedger()
+	if err := ledger.ClaimExclusive([]int{1}); err != nil {
+		t.Fatal(err)
+	}
+	p := NewCoreDevicePlugin(t.TempDir(), m, ledger, device.BinpackPolicy{}, VisibleDevicesIndex)
+
+	_, err := p.Allocate(context.Background(), allocateRequest(coreIDs(0, 0, 10), coreIDs(1, 0, 10)))
+	if status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("got error %v, want %v", err, codes.FailedPrecondition)
+	}
+	if ledger.IsShared(0) {
+		t.Errorf("rejected allocation left gpu 0 claimed")
+	}
+}
+
+func TestCoreMemoryColocation(t *testing.T) {
+	m := newTestManager(t, "2Gi,2Gi,2Gi", testOptions(device.DeviceIDIndex))
+	ledger := device.NewLedger()
+	dir := t.TempDir()
+	memory := NewMemoryDevicePlugin(dir, m, ledger, device.BinpackPolicy{}, VisibleDevicesIndex)
+	core := NewCoreDevicePlugin(dir, m, ledger, device.BinpackPolicy{}, VisibleDevicesIndex)
+
+	preferred := func(p pluginapi.DevicePluginServer, devs []*pluginapi.Device, size int32) []string {
+		t.Helper()
+		resp, err := p.GetPreferredAllocation(context.Background(), &pluginapi.PreferredAllocationRequest{
+			ContainerRequests: []*pluginapi.ContainerPreferredAllocationRequest{{
+				AvailableDeviceIDs: deviceIDs(devs),
+				AllocationSize:     size,
+			}},
+		})
+		if err != nil {
+			t.Fatalf("GetPreferredAllocation: %v", err)
+		}
+		return resp.ContainerResponses[0].DeviceIDs
+	}
+
+	// cores follow the memory allocated right before them
+	if _, err := memory.Allocate(context.Background(), allocateRequest([]string{"MEM-2-0"})); err != nil {
+		t.Fatal(err)
+	}
+	if got := preferred(core, m.GetCoreDevs(), 20); fmt.Sprint(got) != fmt.Sprint(coreIDs(2, 0, 20)) {
+		t.Errorf("got preferred cores %v, want the first 20 of gpu 2", got)
+	}
+
+	// and memory the cores
+	if _, err := core.Allocate(context.Background(), allocateRequest(coreIDs(1, 0, 20))); err != nil {
+		t.Fatal(err)
+	}
+	if got := preferred(memory, m.GetMemoryDevs(), 1); fmt.Sprint(got) != "[MEM-1-0]" {
+		t.Errorf("got preferred memory %v, want [MEM-1-0]", got)
+	}
+	// but not other cores
+	if got := preferred(core, m.GetCoreDevs(), 20); fmt.Sprint(got) == fmt.Sprint(coreIDs(1, 20, 40)) {
+		t.Errorf("got preferred cores %v next to the latest cores", got)
+	}
+}
+
+func TestCorePreStartContainer(t *testing.T) {
+	m := newTestManager(t, "2Gi,2Gi", testOptions(device.DeviceIDIndex))
+	p := NewCoreDevicePlugin(t.TempDir(), m, device.NewLedger(), device.BinpackPolicy{}, VisibleDevicesIndex)
+	p.podResources = servePodResources(t,
+		podResources("together", map[string][]string{
+			CoreResourceName:   coreIDs(0, 0, 10),
+			MemoryResourceName: {"MEM-0-0"},
+		}),
+		podResources("apart",
+			map[string][]string{MemoryResourceName: {"MEM-1-0"}},
+			map[string][]string{
+				CoreResourceName:   coreIDs(0, 10, 20),
+				MemoryResourceName: {"MEM-1-1"},
+			},
+		),
+		podResources("alone", map[string][]string{CoreResourceName: coreIDs(1, 0, 10)}),
+	)
+
+	tests := []struct {
+		ids  []string
+		code codes.Code
+	}{
+		{coreIDs(0, 0, 10), codes.OK},
+		{coreIDs(0, 10, 20), codes.FailedPrecondition},
+		{coreIDs(1, 0, 10), codes.OK},
+		// not known to kubelet yet
+		{coreIDs(1, 50, 60), codes.OK},
+		{[]string{"MEM-0-0"}, codes.InvalidArgument},
+	}
+	for _, tt := range tests {
+		_, err := p.PreStartContainer(context.Background(), &pluginapi.PreStartContainerRequest{DevicesIDs: tt.ids})
+		if status.Code(err) != tt.code {
+			t.Errorf("PreStartContainer(%s...): got error %v, want %v", tt.ids[0], err, tt.code)
+		}
+	}
+
+	// kubelet out of reach
+	p.podResources = "/nonexistent/kubelet.sock"
+	if _, err := p.PreStartContainer(context.Background(), &pluginapi.PreStartContainerRequest{DevicesIDs: coreIDs(0, 10, 20)}); err != nil {
+		t.Errorf("PreStartContainer without kubelet: %v", err)
+	}
+}
@@ -18,17 +18,14 @@ package plugin
 
 import (
 	"github.com/WLBF/flex-gpu-device-plugin/device"
-	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 	"k8s.io/klog/v2"
-	"log"
-	"net"
-	"os"
-	"path"
 	"path/filepath"
-	"time"
+	"strconv"
+	"strings"
 
 	"golang.org/x/net/context"
-	"google.golang.org/grpc"
 	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
 )
 
@@ -37,209 +34,140 @@ const (
 	MemorySockName     = "flex-nvidia-gpu-memory.sock"
 )
 
-var _ DevicePlugin = &MemoryDevicePlugin{}
-
-// MemoryDevicePlugin implements the Kubernetes device plugin API
-type MemoryDevicePlugin struct {
-	resourceName string
-	socket       string
-	manager      device.Manager
-
-	server *grpc.Server
-	stop   chan interface{}
+// MemoryResourceNameFor returns the resource name of memory devices of unit.
+// The default unit keeps the plain resource name, other units are part of the
+// name, e.g. nvidia.flex.com/memory-256mi.
+func MemoryResourceNameFor(unit device.Quantity) string {
+	return withMemoryUnit(MemoryResourceName, unit)
 }
 
-// NewMemoryDevicePlugin returns an initialized MemoryDevicePlugin
-func NewMemoryDevicePlugin(path string, manager device.Manager) *MemoryDevicePlugin {
-	return &MemoryDevicePlugin{
-		resourceName: MemoryResourceName,
-		socket:       filepath.Join(path, MemorySockName),
-		manager:      manager,
-
-		// These will be reinitialized every
-		// time the plugin server is restarted.
-		server: nil,
-		stop:   nil,
+// withMemoryUnit appends unit to a memory resource name unless it is the
+// default unit.
+func withMemoryUnit(name string, unit device.Quantity) string {
+	if unit == device.DefaultMemoryUnit {
+		return name
 	}
+	return name + "-" + strings.ToLower(unit.String())
 }
 
-func (m *MemoryDevicePlugin) initialize() {
-	m.server = grpc.NewServer([]grpc.ServerOption{}...)
-	m.stop = make(chan interface{})
-}
-
-func (m *MemoryDevicePlugin) cleanup() {
-	close(m.stop)
-	m.server = nil
-	m.stop = nil
-}
-
-// Start starts the gRPC server, registers the device plugin with the Kubelet,
-// and starts the device healthchecks.
-func (m *MemoryDevicePlugin) Start() error {
-	m.initialize()
-
-	err := m.Serve()
-	if err != nil {
-		log.Printf("Could not start device plugin for '%s': %s", m.resourceName, err)
-		m.cleanup()
-		return err
-	}
-	log.Printf("Starting to serve '%s' on %s", m.resourceName, m.socket)
+var _ DevicePlugin = &MemoryDevicePlugin{}
 
-	err = m.Register()
-	if err != nil {
-		log.Printf("Could not register device plugin: %s", err)
-		m.Stop()
-		return err
-	}
-	log.Printf("Registered device plugin for '%s' with Kubelet", m.resourceName)
+// MemoryDevicePlugin implements the Kubernetes device plugin API
+type MemoryDevicePlugin struct {
+	pluginServer
 
-	return nil
+	manager  device.Manager
+	ledger   *device.Ledger
+	policy   device.Policy
+	strategy string
 }
 
-// Stop stops the gRPC server.
-func (m *MemoryDevicePlugin) Stop() error {
-	if m == nil || m.server == nil {
-		return nil
-	}
-	log.Printf("Stopping to serve '%s' on %s", m.resourceName, m.socket)
-	m.server.Stop()
-	if err := os.Remove(m.socket); err != nil && !os.IsNotExist(err) {
-		return err
+// NewMemoryDevicePlugin returns an initialized MemoryDevicePlugin
+func NewMemoryDevicePlugin(path string, manager device.Manager, ledger *device.Ledger, policy device.Policy, strategy string) *MemoryDevicePlugin {
+	m := &MemoryDevicePlugin{
+		manager:  manager,
+		ledger:   ledger,
+		policy:   policy,
+		strategy: strategy,
 	}
-	m.cleanup()
-	return nil
+	m.pluginServer = newPluginServer(MemoryResourceNameFor(manager.GetMemoryUnit()), filepath.Join(path, MemorySockName), true, m)
+	return m
 }
 
-// Serve starts the gRPC server of the device plugin.
-func (m *MemoryDevicePlugin) Serve() error {
-	os.Remove(m.socket)
-	sock, err := net.Listen("unix", m.socket)
-	if err != nil {
-		return err
-	}
-
-	pluginapi.RegisterDevicePluginServer(m.server, m)
-
-	go func() {
-		lastCrashTime := time.Now()
-		restartCount := 0
-		for {
-			log.Printf("Starting GRPC server for '%s'", m.resourceName)
-			err := m.server.Serve(sock)
-			if err == nil {
-				break
-			}
-
-			log.Printf("GRPC server for '%s' crashed with error: %v", m.resourceName, err)
+// NewModelMemoryDevicePlugin returns a MemoryDevicePlugin for the GPUs of one
+// model, whose resource name is nvidia.flex.com/<model>-memory.
+func NewModelMemoryDevicePlugin(path string, model string, manager device.Manager, ledger *device.Ledger, policy device.Policy, strategy string) *MemoryDevicePlugin {
+	m := NewMemoryDevicePlugin(path, manager, ledger, policy, strategy)
+	m.resourceName = withMemoryUnit(ResourceDomain+model+"-memory", manager.GetMemoryUnit())
+	m.socket = filepath.Join(path, "flex-nvidia-gpu-"+model+"-memory.sock")
+	return m
+}
 
-			// restart if it has not been too often
-			// i.e. if server has crashed more than 5 times and it didn't last more than one hour each time
-			if restartCount > 5 {
-				// quit
-				log.Fatalf("GRPC server for '%s' has repeatedly crashed recently. Quitting", m.resourceName)
-			}
-			timeSinceLastCrash := time.Since(lastCrashTime).Seconds()
-			lastCrashTime = time.Now()
-			if timeSinceLastCrash > 3600 {
-				// it has been one hour since the last crash.. reset the count
-				// to reflect on the frequency
-				restartCount = 1
-			} else {
-				restartCount++
+// ListAndWatch lists devices and update that list according to the health status
+func (m *MemoryDevicePlugin) ListAndWatch(e *pluginapi.Empty, s pluginapi.DevicePlugin_ListAndWatchServer) error {
+	stop := m.stop
+	updates, cancel := m.manager.Subscribe()
+	defer cancel()
+	ledgerUpdates, cancelLedger := m.ledger.Subscribe()
+	defer cancelLedger()
+
+	var last []*pluginapi.Device
+	sent := false
+	for {
+		devices := m.devices()
+		if !sent || !devicesEqual(last, devices) {
+			klog.V(6).InfoS("memory size", "size", len(devices))
+			if err := s.Send(&pluginapi.ListAndWatchResponse{Devices: devices}); err != nil {
+				return err
 			}
+			last = devices
+			sent = true
 		}
-	}()
 
-	// Wait for server to start by launching a blocking connexion
-	conn, err := m.dial(m.socket, 5*time.Second)
-	if err != nil {
-		return err
-	}
-	conn.Close()
-
-	return nil
-}
-
-// Register registers the device plugin for the given resourceName with Kubelet.
-func (m *MemoryDevicePlugin) Register() error {
-	conn, err := m.dial(pluginapi.KubeletSocket, 5*time.Second)
-	if err != nil {
-		return err
-	}
-	defer conn.Close()
-
-	client := pluginapi.NewRegistrationClient(conn)
-	reqt := &pluginapi.RegisterRequest{
-		Version:      pluginapi.Version,
-		Endpoint:     path.Base(m.socket),
-		ResourceName: m.resourceName,
-		Options: &pluginapi.DevicePluginOptions{
-			GetPreferredAllocationAvailable: false,
-			PreStartRequired:                false,
-		},
-	}
-
-	_, err = client.Register(context.Background(), reqt)
-	if err != nil {
-		return err
+		select {
+		case <-s.Context().Done():
+			return nil
+		case <-stop:
+			return nil
+		case <-updates:
+		case <-ledgerUpdates:
+		}
 	}
-	return nil
 }
 
-// GetDevicePluginOptions returns the values of the optional settings for this plugin
-func (m *MemoryDevicePlugin) GetDevicePluginOptions(context.Context, *pluginapi.Empty) (*pluginapi.DevicePluginOptions, error) {
-	options := &pluginapi.DevicePluginOptions{
-		GetPreferredAllocationAvailable: false,
-		PreStartRequired:                false,
-	}
-	return options, nil
-}
-
-// ListAndWatch lists devices and update that list according to the health status
-func (m *MemoryDevicePlugin) ListAndWatch(e *pluginapi.Empty, s pluginapi.DevicePlugin_ListAndWatchServer) error {
-	devices := m.manager.GetMemoryDevs()
-	klog.V(6).InfoS("memory size", "size", len(devices))
-
-	if err := s.Send(&pluginapi.ListAndWatchResponse{Devices: devices}); err != nil {
-		return err
-	}
-	<-s.Context().Done()
-	return nil
+// devices returns the memory devices of the manager, with the ones of
+// exclusively allocated GPUs reported unhealthy.
+func (m *MemoryDevicePlugin) devices() []*pluginapi.Device {
+	return withExclusiveUnhealthy(m.manager, m.ledger, m.manager.GetMemoryDevs(), m.manager.GetMemoryDevsOf)
 }
 
 // GetPreferredAllocation returns the preferred allocation from the set of devices specified in the request
 func (m *MemoryDevicePlugin) GetPreferredAllocation(ctx context.Context, r *pluginapi.PreferredAllocationRequest) (*pluginapi.PreferredAllocationResponse, error) {
-	return &pluginapi.PreferredAllocationResponse{}, nil
+	response := &pluginapi.PreferredAllocationResponse{}
+	for _, req := range r.ContainerRequests {
+		prefer := colocationHint(m.ledger, m.manager.IsCoreDev)
+		devs, err := device.PreferredMemoryDevs(m.manager, m.policy, req.AvailableDeviceIDs, req.MustIncludeDeviceIDs, int(req.AllocationSize), prefer)
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid preferred allocation request for '%s': %v", m.resourceName, err)
+		}
+		klog.V(6).InfoS("preferred memory allocation", "size", req.AllocationSize, "devices", devs)
+
+		response.ContainerResponses = append(response.ContainerResponses, &pluginapi.ContainerPreferredAllocationResponse{
+			DeviceIDs: devs,
+		})
+	}
+	return response, nil
 }
 
 // Allocate which return list of devices.
 func (m *MemoryDevicePlugin) Allocate(ctx context.Context, reqs *pluginapi.AllocateRequest) (*pluginapi.AllocateResponse, error) {
-	// return empty AllocateResponse will cause kubelet error
-	return &pluginapi.AllocateResponse{
-		ContainerResponses: []*pluginapi.ContainerAllocateResponse{{
-			Envs:        map[string]string{},
-			Mounts:      []*pluginapi.Mount{},
-			Devices:     []*pluginapi.DeviceSpec{},
-			Annotations: map[string]string{},
-		}},
-	}, nil
-}
+	owners, err := claimShared(m.manager, m.ledger, m.resourceName, reqs, device.ValidateMemoryAllocation)
+	if err != nil {
+		return nil, err
+	}
 
-// PreStartContainer is unimplemented for this plugin
-func (m *MemoryDevicePlugin) PreStartContainer(context.Context, *pluginapi.PreStartContainerRequest) (*pluginapi.PreStartContainerResponse, error) {
-	return &pluginapi.PreStartContainerResponse{}, nil
-}
+	responses := &pluginapi.AllocateResponse{}
+	for i, req := range reqs.ContainerRequests {
+		gpus := owners[i : i+1]
+		klog.V(6).InfoS("allocate memory", "gpu", gpus[0].Index, "size", len(req.DevicesIDs))
 
-// dial establishes the gRPC communication with the registered device plugin.
-func (m *MemoryDevicePlugin) dial(unixSocketPath string, timeout time.Duration) (*grpc.ClientConn, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), timeout)
-	defer cancel()
+		envs := map[string]string{
+			VisibleDevicesEnv: visibleDevices(m.strategy, gpus),
+			MemoryLimitEnv:    strconv.FormatUint((device.Quantity(len(req.DevicesIDs)) * m.manager.GetMemoryUnit()).MiB(), 10),
+		}
+		annotations := map[string]string{}
+		if ratio := gpus[0].OvercommitRatio; ratio != 1 {
+			envs[OvercommitRatioEnv] = strconv.FormatFloat(ratio, 'f', -1, 64)
+			annotations[OvercommitRatioAnnotation] = envs[OvercommitRatioEnv]
+		}
 
-	return grpc.DialContext(ctx, unixSocketPath, grpc.WithTransportCredentials(insecure.NewCredentials()), grpc.WithBlock(),
-		grpc.WithContextDialer(func(ctx context.Context, addr string) (net.Conn, error) {
-			return net.DialTimeout("unix", addr, timeout)
-		}),
-	)
+		// return empty ContainerAllocateResponse will cause kubelet error
+		responses.ContainerResponses = append(responses.ContainerResponses, &pluginapi.ContainerAllocateResponse{
+			Envs:        envs,
+			Mounts:      []*pluginapi.Mount{},
+			Devices:     deviceSpecs(gpus),
+			Annotations: annotations,
+		})
+	}
+	return responses, nil
 }
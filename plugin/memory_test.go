@@ -0,0 +1,350 @@
+/*
+ * Copyright 2022 lbf1353@live.com
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package plugin
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/WLBF/flex-gpu-device-plugin/device"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+func TestMemoryAllocateConflict(t *testing.T) {
+	m := newTestManager(t, "2Gi,2Gi,2Gi", testOptions(device.DeviceIDIndex))
+	ledger := device.NewLedger()
+	if err := ledger.ClaimExclusive([]int{1}); err != nil {
+		t.Fatal(err)
+	}
+	p := NewMemoryDevicePlugin(t.TempDir(), m, ledger, device.BinpackPolicy{}, VisibleDevicesIndex)
+
+	tests := []struct {
+		name string
+		req  *pluginapi.AllocateRequest
+		code codes.Code
+	}{
+		{"exclusive gpu", allocateRequest([]string{"MEM-0-0"}, []string{"MEM-1-0"}), codes.FailedPrecondition},
+		{"invalid container", allocateRequest([]string{"MEM-0-0"}, []string{"MEM-2-0", "MEM-0-1"}), codes.InvalidArgument},
+		{"unknown device", allocateRequest([]string{"MEM-0-0"}, []string{"MEM-2-7"}), codes.InvalidArgument},
+	}
+	for _, tt := range tests {
+		if _, err := p.Allocate(context.Background(), tt.req); status.Code(err) != tt.code {
+			t.Errorf("%s: got error %v, want %v", tt.name, err, tt.code)
+		}
+		// the valid containers are not claimed either
+		if ledger.IsShared(0) || ledger.IsShared(2) {
+			t.Errorf("%s: rejected allocation left claims behind", tt.name)
+		}
+	}
+}
+
+func TestMemoryResourceName(t *testing.T) {
+	tests := []struct {
+		unit  device.Quantity
+		name  string
+		model string
+		limit string
+	}{
+		{device.GiB, "nvidia.flex.com/memory", "nvidia.flex.com/mock-memory", "3072"},
+		{256 * device.MiB, "nvidia.flex.com/memory-256mi", "nvidia.flex.com/mock-memory-256mi", "768"},
+		{2 * device.GiB, "nvidia.flex.com/memory-2gi", "nvidia.flex.com/mock-memory-2gi", "6144"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.unit.String(), func(t *testing.T) {
+			opts := testOptions(device.DeviceIDIndex)
+			opts.MemoryUnit = tt.unit
+			m := newTestManager(t, "8Gi", opts)
+			p := NewMemoryDevicePlugin(t.TempDir(), m, device.NewLedger(), device.BinpackPolicy{}, VisibleDevicesIndex)
+			if got := MemoryResourceNameFor(tt.unit); got != tt.name || p.resourceName != tt.name {
+				t.Errorf("got resource name %q and %q, want %q", got, p.resourceName, tt.name)
+			}
+			model := NewModelMemoryDevicePlugin(t.TempDir(), "mock", m, device.NewLedger(), device.BinpackPolicy{}, VisibleDevicesIndex)
+			if model.resourceName != tt.model {
+				t.Errorf("got model resource name %q, want %q", model.resourceName, tt.model)
+			}
+
+			resp, err := p.Allocate(context.Background(), allocateRequest([]string{"MEM-0-0", "MEM-0-1", "MEM-0-2"}))
+			if err != nil {
+				t.Fatalf("Allocate: %v", err)
+			}
+			if got := resp.ContainerResponses[0].Envs[MemoryLimitEnv]; got != tt.limit {
+				t.Errorf("%s = %q, want %q", MemoryLimitEnv, got, tt.limit)
+			}
+		})
+	}
+}
+
+func TestMemoryResourceNameCoarsened(t *testing.T) {
+	opts := testOptions(device.DeviceIDIndex)
+	opts.MemoryUnit = 256 * device.MiB
+	opts.MaxMemoryDevs = 16
+	m := newTestManager(t, "8Gi", opts)
+	p := NewMemoryDevicePlugin(t.TempDir(), m, device.NewLedger(), device.BinpackPolicy{}, VisibleDevicesIndex)
+	if want := "nvidia.flex.com/memory-512mi"; p.resourceName != want {
+		t.Errorf("got resource name %q, want %q", p.resourceName, want)
+	}
+
+	resp, err := p.Allocate(context.Background(), allocateRequest([]string{"MEM-0-0", "MEM-0-1", "MEM-0-2"}))
+	if err != nil {
+		t.Fatalf("Allocate: %v", err)
+	}
+	if got, want := resp.ContainerResponses[0].Envs[MemoryLimitEnv], "1536"; got != want {
+		t.Errorf("%s = %q, want %q", MemoryLimitEnv, got, want)
+	}
+}
+
+func TestMemoryAllocateReservedMemory(t *testing.T) {
+	opts := testOptions(device.DeviceIDIndex)
+	opts.ReservedMemory = device.Reservation{Memory: device.GiB}
+	m := newTestManager(t, "16Gi,16Gi", opts)
+	p := NewMemoryDevicePlugin(t.TempDir(), m, device.NewLedger(), device.BinpackPolicy{}, VisibleDevicesIndex)
+	if got, want := len(p.devices()), 30; got != want {
+		t.Errorf("got %d memory devices, want %d", got, want)
+	}
+
+	resp, err := p.Allocate(context.Background(), allocateRequest(deviceIDs(m.GetMemoryDevsOf(0))))
+	if err != nil {
+		t.Fatalf("Allocate: %v", err)
+	}
+	if got, want := resp.ContainerResponses[0].Envs[MemoryLimitEnv], "15360"; got != want {
+		t.Errorf("%s = %q, want %q", MemoryLimitEnv, got, want)
+	}
+}
+
+func TestMemoryAllocateOvercommitRatio(t *testing.T) {
+	opts := testOptions(device.DeviceIDIndex)
+	opts.OvercommitRatio = 1.5
+	opts.OvercommitLimit = 48 * device.GiB
+	m := newTestManager(t, "16Gi,40Gi,64Gi", opts)
+	p := NewMemoryDevicePlugin(t.TempDir(), m, device.NewLedger(), device.BinpackPolicy{}, VisibleDevicesIndex)
+
+	resp, err := p.Allocate(context.Background(), allocateRequest(
+		[]string{"MEM-0-0"},
+		[]string{"MEM-1-0"},
+		[]string{"MEM-2-0"},
+	))
+	if err != nil {
+		t.Fatalf("Allocate: %v", err)
+	}
+	for i, want := range []string{"1.5", "1.2", ""} {
+		c := resp.ContainerResponses[i]
+		if got := c.Envs[OvercommitRatioEnv]; got != want {
+			t.Errorf("container %d: %s = %q, want %q", i, OvercommitRatioEnv, got, want)
+		}
+		if got := c.Annotations[OvercommitRatioAnnotation]; got != want {
+			t.Errorf("container %d: %s annotation = %q, want %q", i, OvercommitRatioAnnotation, got, want)
+		}
+	}
+}
+
+func TestMemoryAllocateDeviceSpecs(t *testing.T) {
+	var fakes []*device.FakeDevice
+	for i, minor := range []int{0, 3} {
+		fakes = append(fakes, &device.FakeDevice{
+			UUID:              fmt.Sprintf("GPU-00000000-0000-0000-0000-%012d", i),
+			Name:              "Tesla T4",
+			Minor:             minor,
+			Memory:            (16 * device.GiB).Bytes(),
+			PciBusID:          fmt.Sprintf("00000000:%02X:00.0", i+1),
+			NumaNode:          -1,
+			ComputeCapability: [2]int{7, 5},
+		})
+	}
+	m, err := device.NewGPUManagerWithNVML(device.NewFakeNVML(fakes...), testOptions(device.DeviceIDIndex))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	p := NewMemoryDevicePlugin(t.TempDir(), m, device.NewLedger(), device.BinpackPolicy{}, VisibleDevicesIndex)
+
+	resp, err := p.Allocate(context.Background(), allocateRequest([]string{"MEM-1-0", "MEM-1-1"}))
+	if err != nil {
+		t.Fatalf("Allocate: %v", err)
+	}
+	var paths []string
+	for _, spec := range resp.ContainerResponses[0].Devices {
+		if spec.HostPath != spec.ContainerPath || spec.Permissions != "rw" {
+			t.Errorf("got device spec %v, want %s mounted rw at the same path", spec, spec.HostPath)
+		}
+		paths = append(paths, spec.HostPath)
+	}
+	if got, want := fmt.Sprint(paths), "[/dev/nvidiactl /dev/nvidia-uvm /dev/nvidia3]"; got != want {
+		t.Errorf("got device nodes %s, want %s", got, want)
+	}
+
+	// mock gpus have no device nodes
+	mock := NewMemoryDevicePlugin(t.TempDir(), newTestManager(t, "2Gi", testOptions(device.DeviceIDIndex)), device.NewLedger(),
+		device.BinpackPolicy{}, VisibleDevicesIndex)
+	resp, err = mock.Allocate(context.Background(), allocateRequest([]string{"MEM-0-0"}))
+	if err != nil {
+		t.Fatalf("Allocate: %v", err)
+	}
+	if devs := resp.ContainerResponses[0].Devices; len(devs) != 0 {
+		t.Errorf("got device specs %v for a mock gpu, want none", devs)
+	}
+}
+
+func TestMemoryAllocateContainers(t *testing.T) {
+	opts := testOptions(device.DeviceIDIndex)
+	opts.MemoryUnit = device.GiB
+	m := newTestManager(t, "4Gi,4Gi,4Gi", opts)
+	ledger := device.NewLedger()
+	p := NewMemoryDevicePlugin(t.TempDir(), m, ledger, device.BinpackPolicy{}, VisibleDevicesIndex)
+
+	resp, err := p.Allocate(context.Background(), allocateRequest(
+		[]string{"MEM-0-0", "MEM-0-1"},
+		[]string{"MEM-2-3"},
+		[]string{"MEM-0-2"},
+	))
+	if err != nil {
+		t.Fatalf("Allocate: %v", err)
+	}
+	if got := len(resp.ContainerResponses); got != 3 {
+		t.Fatalf("got %d container responses, want 3", got)
+	}
+	for i, want := range []struct{ visible, limit string }{{"0", "2048"}, {"2", "1024"}, {"0", "1024"}} {
+		envs := resp.ContainerResponses[i].Envs
+		if envs[VisibleDevicesEnv] != want.visible || envs[MemoryLimitEnv] != want.limit {
+			t.Errorf("container %d: %s = %q and %s = %q, want %q and %q", i, VisibleDevicesEnv, envs[VisibleDevicesEnv],
+				MemoryLimitEnv, envs[MemoryLimitEnv], want.visible, want.limit)
+		}
+	}
+	for _, idx := range []int{0, 2} {
+		if !ledger.IsShared(idx) {
+			t.Errorf("gpu %d is not shared after allocating its memory", idx)
+		}
+	}
+	if ledger.IsShared(1) {
+		t.Errorf("gpu 1 is shared without memory allocated")
+	}
+
+	// a container may not span gpus, even when the others are valid
+	_, err = p.Allocate(context.Background(), allocateRequest(
+		[]string{"MEM-1-0"},
+		[]string{"MEM-1-1", "MEM-2-0"},
+	))
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("Allocate across gpus: got error %v, want %v", err, codes.InvalidArgument)
+	}
+}
+
+func TestMemoryListAndWatch(t *testing.T) {
+	opts := testOptions(device.DeviceIDIndex)
+	opts.MemoryUnit = device.GiB
+	m := newTestManager(t, "2Gi,2Gi", opts)
+	ledger := device.NewLedger()
+	p := NewMemoryDevicePlugin(t.TempDir(), m, ledger, device.BinpackPolicy{}, VisibleDevicesIndex)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s := newFakeListAndWatchServer(ctx)
+	errc := make(chan error, 1)
+	go func() { errc <- p.ListAndWatch(&pluginapi.Empty{}, s) }()
+
+	healthy, unhealthy := pluginapi.Healthy, pluginapi.Unhealthy
+	steps := []struct {
+		name   string
+		change func()
+		want   map[string]string
+	}{
+		{"initial", func() {}, map[string]string{
+			"MEM-0-0": healthy, "MEM-0-1": healthy, "MEM-1-0": healthy, "MEM-1-1": healthy,
+		}},
+		{"xid on gpu 1", func() { m.SetHealth(1, unhealthy) }, map[string]string{
+			"MEM-0-0": healthy, "MEM-0-1": healthy, "MEM-1-0": unhealthy, "MEM-1-1": unhealthy,
+		}},
+		{"gpu 0 allocated exclusively", func() {
+			if err := ledger.ClaimExclusive([]int{0}); err != nil {
+				t.Fatal(err)
+			}
+		}, map[string]string{
+			"MEM-0-0": unhealthy, "MEM-0-1": unhealthy, "MEM-1-0": unhealthy, "MEM-1-1": unhealthy,
+		}},
+		{"gpu 1 recovered", func() { m.SetHealth(1, healthy) }, map[string]string{
+			"MEM-0-0": unhealthy, "MEM-0-1": unhealthy, "MEM-1-0": healthy, "MEM-1-1": healthy,
+		}},
+	}
+	for _, step := range steps {
+		step.change()
+		if got := s.recv(t); !reflect.DeepEqual(got, step.want) {
+			t.Errorf("%s: got devices %v, want %v", step.name, got, step.want)
+		}
+	}
+
+	cancel()
+	if err := <-errc; err != nil {
+		t.Errorf("ListAndWatch: %v", err)
+	}
+	if len(s.responses) != 0 {
+		t.Errorf("%d unchanged device lists sent", len(s.responses))
+	}
+}
+
+// newBenchManager returns a manager of 10 GPUs of 80Gi sliced in 102400
+// memory devices of 8Mi.
+func newBenchManager(b *testing.B) *device.GPUManager {
+	opts := testOptions(device.DeviceIDIndex)
+	opts.MemoryUnit = 8 * device.MiB
+	return newTestManager(b, "80Gi,80Gi,80Gi,80Gi,80Gi,80Gi,80Gi,80Gi,80Gi,80Gi", opts)
+}
+
+func BenchmarkMemoryDevices(b *testing.B) {
+	m := newBenchManager(b)
+	p := NewMemoryDevicePlugin(b.TempDir(), m, device.NewLedger(), device.BinpackPolicy{}, VisibleDevicesIndex)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		p.devices()
+	}
+}
+
+func BenchmarkMemoryDevicesExclusive(b *testing.B) {
+	m := newBenchManager(b)
+	ledger := device.NewLedger()
+	if err := ledger.ClaimExclusive([]int{0}); err != nil {
+		b.Fatal(err)
+	}
+	p := NewMemoryDevicePlugin(b.TempDir(), m, ledger, device.BinpackPolicy{}, VisibleDevicesIndex)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		p.devices()
+	}
+}
+
+func BenchmarkModelMemoryDevices(b *testing.B) {
+	m := newBenchManager(b)
+	sub := device.NewSubsetManager(m, func(gpu device.GPUInfo) bool { return gpu.Index%2 == 0 })
+	p := NewModelMemoryDevicePlugin(b.TempDir(), "mock", sub, device.NewLedger(), device.BinpackPolicy{}, VisibleDevicesIndex)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		p.devices()
+	}
+}
+
+func BenchmarkMemoryAllocate(b *testing.B) {
+	m := newBenchManager(b)
+	p := NewMemoryDevicePlugin(b.TempDir(), m, device.NewLedger(), device.BinpackPolicy{}, VisibleDevicesIndex)
+	req := allocateRequest(deviceIDs(m.GetMemoryDevsOf(9)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := p.Allocate(context.Background(), req); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+/*
+ * Copyright 2022 lbf1353@live.com
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package plugin
+
+import (
+	"github.com/WLBF/flex-gpu-device-plugin/device"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2"
+	"path/filepath"
+
+	"golang.org/x/net/context"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+// MigResourcePrefix is the prefix of the resource names of MIG devices, which
+// are followed by the MIG profile, e.g. nvidia.flex.com/mig-1g.10gb.
+const MigResourcePrefix = ResourceDomain + "mig-"
+
+var _ DevicePlugin = &MigDevicePlugin{}
+
+// MigDevicePlugin implements the Kubernetes device plugin API for the MIG
+// devices of one profile.
+type MigDevicePlugin struct {
+	pluginServer
+
+	profile  string
+	manager  device.Manager
+	strategy string
+}
+
+// NewMigDevicePlugin returns an initialized MigDevicePlugin for the MIG
+// devices of profile.
+func NewMigDevicePlugin(path string, profile string, manager device.Manager, strategy string) *MigDevicePlugin {
+	m := &MigDevicePlugin{
+		profile:  profile,
+		manager:  manager,
+		strategy: strategy,
+	}
+	m.pluginServer = newPluginServer(MigResourcePrefix+profile, filepath.Join(path, "flex-nvidia-gpu-mig-"+profile+".sock"), false, m)
+	return m
+}
+
+// ListAndWatch lists devices and update that list according to the health status
+func (m *MigDevicePlugin) ListAndWatch(e *pluginapi.Empty, s pluginapi.DevicePlugin_ListAndWatchServer) error {
+	stop := m.stop
+	updates, cancel := m.manager.Subscribe()
+	defer cancel()
+
+	var last []*pluginapi.Device
+	sent := false
+	for {
+		devices := m.manager.GetMigDevs(m.profile)
+		if !sent || !devicesEqual(last, devices) {
+			if err := s.Send(&pluginapi.ListAndWatchResponse{Devices: devices}); err != nil {
+				return err
+			}
+			last = devices
+			sent = true
+		}
+
+		select {
+		case <-s.Context().Done():
+			return nil
+		case <-stop:
+			return nil
+		case <-updates:
+		}
+	}
+}
+
+// GetPreferredAllocation returns the preferred allocation from the set of devices specified in the request
+func (m *MigDevicePlugin) GetPreferredAllocation(ctx context.Context, r *pluginapi.PreferredAllocationRequest) (*pluginapi.PreferredAllocationResponse, error) {
+	return &pluginapi.PreferredAllocationResponse{}, nil
+}
+
+// Allocate which return list of devices.
+func (m *MigDevicePlugin) Allocate(ctx context.Context, reqs *pluginapi.AllocateRequest) (*pluginapi.AllocateResponse, error) {
+	known := make(map[string]struct{})
+	for _, dev := range m.manager.GetMigDevs(m.profile) {
+		known[dev.ID] = struct{}{}
+	}
+
+	responses := &pluginapi.AllocateResponse{}
+	for _, req := range reqs.ContainerRequests {
+		var migs []device.MigInfo
+		parents := make(map[int]struct{})
+		for _, id := range req.DevicesIDs {
+			if _, ok := known[id]; !ok {
+				return nil, status.Errorf(codes.InvalidArgument, "invalid allocation request for '%s': unknown device: %s", m.resourceName, id)
+			}
+			mig, err := m.manager.ParseMigDevID(id)
+			if err != nil {
+				return nil, status.Errorf(codes.InvalidArgument, "invalid allocation request for '%s': %v", m.resourceName, err)
+			}
+			migs = append(migs, mig)
+			parents[mig.Parent] = struct{}{}
+		}
+
+		gpus, err := lookupGPUs(m.manager, sortedIndexes(parents))
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "allocate '%s': %v", m.resourceName, err)
+		}
+		klog.V(6).InfoS("allocate mig devices", "profile", m.profile, "devices", req.DevicesIDs)
+
+		// return empty ContainerAllocateResponse will cause kubelet error
+		responses.ContainerResponses = append(responses.ContainerResponses, &pluginapi.ContainerAllocateResponse{
+			Envs: map[string]string{
+				VisibleDevicesEnv: visibleMigDevices(m.strategy, migs),
+			},
+			Mounts:      []*pluginapi.Mount{},
+			Devices:     deviceSpecs(gpus),
+			Annotations: map[string]string{},
+		})
+	}
+	return responses, nil
+}
@@ -0,0 +1,103 @@
+/*
+ * Copyright 2022 lbf1353@live.com
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package plugin
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/WLBF/flex-gpu-device-plugin/device"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// newMigTestManager returns a manager of a whole gpu 0 and of gpu 1 split
+// into two 1g.5gb and one 3g.20gb MIG devices.
+func newMigTestManager(t *testing.T) *device.GPUManager {
+	t.Helper()
+	a100 := &device.FakeDevice{
+		UUID:              "GPU-a100",
+		Name:              "NVIDIA A100-SXM4-40GB",
+		Minor:             1,
+		Memory:            (40 * device.GiB).Bytes(),
+		NumaNode:          -1,
+		ComputeCapability: [2]int{8, 0},
+	}
+	if err := device.SetFakeMigDevices(a100, "1g.5gb", "3g.20gb", "1g.5gb"); err != nil {
+		t.Fatal(err)
+	}
+	t4 := &device.FakeDevice{
+		UUID:              "GPU-t4",
+		Name:              "Tesla T4",
+		Minor:             0,
+		Memory:            (16 * device.GiB).Bytes(),
+		NumaNode:          -1,
+		ComputeCapability: [2]int{7, 5},
+	}
+	m, err := device.NewGPUManagerWithNVML(device.NewFakeNVML(t4, a100), testOptions(device.DeviceIDIndex))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { m.Close() })
+	return m
+}
+
+func TestMigAllocate(t *testing.T) {
+	tests := []struct {
+		strategy string
+		visible  []string
+	}{
+		{VisibleDevicesIndex, []string{"1:2", "1:0"}},
+		{VisibleDevicesUUID, []string{"MIG-GPU-a100-2", "MIG-GPU-a100-0"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.strategy, func(t *testing.T) {
+			p := NewMigDevicePlugin(t.TempDir(), "1g.5gb", newMigTestManager(t), tt.strategy)
+			resp, err := p.Allocate(context.Background(), allocateRequest([]string{"MIG-GPU-a100-2"}, []string{"MIG-GPU-a100-0"}))
+			if err != nil {
+				t.Fatalf("Allocate: %v", err)
+			}
+			for i, cresp := range resp.ContainerResponses {
+				if got := cresp.Envs[VisibleDevicesEnv]; got != tt.visible[i] {
+					t.Errorf("container %d: %s = %q, want %q", i, VisibleDevicesEnv, got, tt.visible[i])
+				}
+				var paths []string
+				for _, spec := range cresp.Devices {
+					paths = append(paths, spec.HostPath)
+				}
+				if got, want := fmt.Sprint(paths), "[/dev/nvidiactl /dev/nvidia-uvm /dev/nvidia1]"; got != want {
+					t.Errorf("container %d: got device nodes %s, want %s", i, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestMigAllocateUnknown(t *testing.T) {
+	p := NewMigDevicePlugin(t.TempDir(), "1g.5gb", newMigTestManager(t), VisibleDevicesIndex)
+	for _, ids := range [][]string{
+		// a device of another profile
+		{"MIG-GPU-a100-1"},
+		{"MIG-GPU-a100-0", "MIG-GPU-a100-9"},
+		{"GPU-0"},
+	} {
+		if _, err := p.Allocate(context.Background(), allocateRequest(ids)); status.Code(err) != codes.InvalidArgument {
+			t.Errorf("Allocate(%v) = %v, want %v", ids, err, codes.InvalidArgument)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+/*
+ * Copyright 2022 lbf1353@live.com
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package plugin
+
+import (
+	"fmt"
+	"github.com/WLBF/flex-gpu-device-plugin/device"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// modelNameRegexp matches model names usable in resource names and sockets.
+var modelNameRegexp = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]*[a-z0-9])?$`)
+
+// ParseModelRenames parses comma separated <product name>=<model name> pairs,
+// e.g. "NVIDIA A100-SXM4-40GB=a100,Tesla T4=t4".
+func ParseModelRenames(str string) (map[string]string, error) {
+	renames := make(map[string]string)
+	for _, s := range strings.Split(str, ",") {
+		if len(strings.TrimSpace(s)) == 0 {
+			continue
+		}
+		kv := strings.SplitN(s, "=", 2)
+		if len(kv) != 2 || len(strings.TrimSpace(kv[0])) == 0 {
+			return nil, fmt.Errorf("invalid model rename %q: must be <product name>=<model name>", s)
+		}
+		product, model := strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1])
+		if !modelNameRegexp.MatchString(model) {
+			return nil, fmt.Errorf("invalid model name %q: must consist of lower case alphanumeric characters or '-'", model)
+		}
+		renames[product] = model
+	}
+	return renames, nil
+}
+
+// ModelName returns the model name of a GPU product used in per-model resource
+// names, taken from renames or else derived from the product name, e.g.
+// "Tesla T4" is t4 and "NVIDIA A100-SXM4-40GB" is a100-sxm4-40gb. It fails if
+// no valid model name can be derived, the product must be renamed then.
+func ModelName(product string, renames map[string]string) (string, error) {
+	if model, ok := renames[product]; ok {
+		return model, nil
+	}
+	model := strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') {
+			return r
+		}
+		return '-'
+	}, strings.ToLower(product))
+	for _, vendor := range []string{"nvidia-", "tesla-", "geforce-", "quadro-"} {
+		model = strings.TrimPrefix(model, vendor)
+	}
+	for strings.Contains(model, "--") {
+		model = strings.ReplaceAll(model, "--", "-")
+	}
+	model = strings.Trim(model, "-")
+	if !modelNameRegexp.MatchString(model) {
+		return "", fmt.Errorf("no model name can be derived from gpu product %q, name it with a model rename", product)
+	}
+	return model, nil
+}
+
+// ModelManagers splits the GPUs of manager by model name, returning a
+// Manager restricted to the GPUs of each model.
+func ModelManagers(manager device.Manager, renames map[string]string) (map[string]device.Manager, error) {
+	// products maps the product names to their model name.
+	products := make(map[string]string)
+	for _, gpu := range manager.GetGPUs() {
+		model, err := ModelName(gpu.Name, renames)
+		if err != nil {
+			return nil, err
+		}
+		products[gpu.Name] = model
+	}
+
+	managers := make(map[string]device.Manager)
+	for _, model := range products {
+		model := model
+		managers[model] = device.NewSubsetManager(manager, func(gpu device.GPUInfo) bool {
+			return products[gpu.Name] == model
+		})
+	}
+	return managers, nil
+}
+
+// sortedModels returns the model names of managers in ascending order.
+func sortedModels(managers map[string]device.Manager) []string {
+	var models []string
+	for model := range managers {
+		models = append(models, model)
+	}
+	sort.Strings(models)
+	return models
+}
+
+// NewModelDevicePlugins returns a monopoly, a memory and a core device plugin
+// for each GPU model of manager, named after the model, e.g.
+// nvidia.flex.com/t4-gpu, nvidia.flex.com/t4-memory and nvidia.flex.com/t4-core.
+func NewModelDevicePlugins(path string, manager device.Manager, renames map[string]string, ledger *device.Ledger, policy device.Policy, strategy string) ([]DevicePlugin, error) {
+	managers, err := ModelManagers(manager, renames)
+	if err != nil {
+		return nil, err
+	}
+
+	var plugins []DevicePlugin
+	for _, model := range sortedModels(managers) {
+		plugins = append(plugins,
+			NewModelMonopolyDevicePlugin(path, model, managers[model], ledger, strategy),
+			NewModelMemoryDevicePlugin(path, model, managers[model], ledger, policy, strategy),
+			NewModelCoreDevicePlugin(path, model, managers[model], ledger, policy, strategy),
+		)
+	}
+	return plugins, nil
+}
@@ -0,0 +1,144 @@
+/*
+ * Copyright 2022 lbf1353@live.com
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package plugin
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/WLBF/flex-gpu-device-plugin/device"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+func TestParseModelRenames(t *testing.T) {
+	tests := []struct {
+		str  string
+		want map[string]string
+		err  bool
+	}{
+		{str: "", want: map[string]string{}},
+		{
+			str:  "NVIDIA A100-SXM4-40GB=a100, Tesla T4 = t4,",
+			want: map[string]string{"NVIDIA A100-SXM4-40GB": "a100", "Tesla T4": "t4"},
+		},
+		{str: "Tesla T4", err: true},
+		{str: "=t4", err: true},
+		{str: "Tesla T4=T4", err: true},
+		{str: "Tesla T4=t4-", err: true},
+		{str: "Tesla T4=", err: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseModelRenames(tt.str)
+		if tt.err {
+			if err == nil {
+				t.Errorf("ParseModelRenames(%q) = %v, want error", tt.str, got)
+			}
+			continue
+		}
+		if err != nil || fmt.Sprint(got) != fmt.Sprint(tt.want) {
+			t.Errorf("ParseModelRenames(%q) = %v, %v, want %v", tt.str, got, err, tt.want)
+		}
+	}
+}
+
+func TestModelName(t *testing.T) {
+	renames := map[string]string{"NVIDIA A100-SXM4-80GB": "a100"}
+	tests := []struct {
+		product string
+		want    string
+		err     bool
+	}{
+		{product: "Tesla T4", want: "t4"},
+		{product: "NVIDIA A100-SXM4-40GB", want: "a100-sxm4-40gb"},
+		{product: "NVIDIA A100-SXM4-80GB", want: "a100"},
+		{product: "NVIDIA GeForce RTX 3090", want: "rtx-3090"},
+		{product: "Quadro RTX 6000 (PCIe)", want: "rtx-6000-pcie"},
+		{product: "", err: true},
+		{product: "NVIDIA ???", err: true},
+	}
+	for _, tt := range tests {
+		got, err := ModelName(tt.product, renames)
+		if tt.err {
+			if err == nil {
+				t.Errorf("ModelName(%q) = %q, want error", tt.product, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("ModelName(%q) = %q, %v, want %q", tt.product, got, err, tt.want)
+		}
+	}
+}
+
+// pluginServerOf returns the plugin server of the device plugin p.
+func pluginServerOf(t *testing.T, p DevicePlugin) *pluginServer {
+	t.Helper()
+	switch p := p.(type) {
+	case *MonopolyDevicePlugin:
+		return &p.pluginServer
+	case *MemoryDevicePlugin:
+		return &p.pluginServer
+	case *CoreDevicePlugin:
+		return &p.pluginServer
+	}
+	t.Fatalf("unexpected device plugin %T", p)
+	return nil
+}
+
+func TestNewModelDevicePlugins(t *testing.T) {
+	lib := device.NewFakeNVML(
+		&device.FakeDevice{UUID: "GPU-t4-0", Name: "Tesla T4", Minor: 0, Memory: (16 * device.GiB).Bytes(), ComputeCapability: [2]int{7, 5}},
+		&device.FakeDevice{UUID: "GPU-a100", Name: "NVIDIA A100-SXM4-40GB", Minor: 1, Memory: (40 * device.GiB).Bytes(), ComputeCapability: [2]int{8, 0}},
+		&device.FakeDevice{UUID: "GPU-t4-1", Name: "Tesla T4", Minor: 2, Memory: (16 * device.GiB).Bytes(), ComputeCapability: [2]int{7, 5}},
+	)
+	m, err := device.NewGPUManagerWithNVML(lib, testOptions(device.DeviceIDIndex))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+
+	path := t.TempDir()
+	plugins, err := NewModelDevicePlugins(path, m, map[string]string{"NVIDIA A100-SXM4-40GB": "a100"}, device.NewLedger(), device.BinpackPolicy{}, VisibleDevicesIndex)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []struct {
+		resourceName string
+		socket       string
+		devices      int
+	}{
+		{"nvidia.flex.com/a100-gpu", "flex-nvidia-gpu-a100-monopoly.sock", 1},
+		{"nvidia.flex.com/a100-memory", "flex-nvidia-gpu-a100-memory.sock", 40},
+		{"nvidia.flex.com/a100-core", "flex-nvidia-gpu-a100-core.sock", 100},
+		{"nvidia.flex.com/t4-gpu", "flex-nvidia-gpu-t4-monopoly.sock", 2},
+		{"nvidia.flex.com/t4-memory", "flex-nvidia-gpu-t4-memory.sock", 32},
+		{"nvidia.flex.com/t4-core", "flex-nvidia-gpu-t4-core.sock", 200},
+	}
+	if len(plugins) != len(want) {
+		t.Fatalf("got %d device plugins, want %d", len(plugins), len(want))
+	}
+	for i, p := range plugins {
+		s := pluginServerOf(t, p)
+		if s.resourceName != want[i].resourceName || s.socket != filepath.Join(path, want[i].socket) {
+			t.Errorf("plugin %d: got %s on %s, want %s on %s", i, s.resourceName, s.socket, want[i].resourceName, want[i].socket)
+		}
+		if got := len(p.(interface{ devices() []*pluginapi.Device }).devices()); got != want[i].devices {
+			t.Errorf("%s: got %d devices, want %d", s.resourceName, got, want[i].devices)
+		}
+	}
+}
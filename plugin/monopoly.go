@@ -18,16 +18,12 @@ package plugin
 
 import (
 	"github.com/WLBF/flex-gpu-device-plugin/device"
-	"google.golang.org/grpc/credentials/insecure"
-	"log"
-	"net"
-	"os"
-	"path"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2"
 	"path/filepath"
-	"time"
 
 	"golang.org/x/net/context"
-	"google.golang.org/grpc"
 	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
 )
 
@@ -40,171 +36,80 @@ var _ DevicePlugin = &MonopolyDevicePlugin{}
 
 // MonopolyDevicePlugin implements the Kubernetes device plugin API
 type MonopolyDevicePlugin struct {
-	resourceName string
-	socket       string
-	manager      device.Manager
+	pluginServer
 
-	server *grpc.Server
-	stop   chan interface{}
+	manager  device.Manager
+	ledger   *device.Ledger
+	strategy string
 }
 
 // NewMonopolyDevicePlugin returns an initialized MemoryDevicePlugin
-func NewMonopolyDevicePlugin(path string, manager device.Manager) *MonopolyDevicePlugin {
-	return &MonopolyDevicePlugin{
-		resourceName: MonopolyResourceName,
-		socket:       filepath.Join(path, MonopolySockName),
-		manager:      manager,
-
-		// These will be reinitialized every
-		// time the plugin server is restarted.
-		server: nil,
-		stop:   nil,
+func NewMonopolyDevicePlugin(path string, manager device.Manager, ledger *device.Ledger, strategy string) *MonopolyDevicePlugin {
+	m := &MonopolyDevicePlugin{
+		manager:  manager,
+		ledger:   ledger,
+		strategy: strategy,
 	}
+	m.pluginServer = newPluginServer(MonopolyResourceName, filepath.Join(path, MonopolySockName), false, m)
+	return m
 }
 
-func (m *MonopolyDevicePlugin) initialize() {
-	m.server = grpc.NewServer([]grpc.ServerOption{}...)
-	m.stop = make(chan interface{})
+// NewModelMonopolyDevicePlugin returns a MonopolyDevicePlugin for the GPUs of
+// one model, whose resource name is nvidia.flex.com/<model>-gpu.
+func NewModelMonopolyDevicePlugin(path string, model string, manager device.Manager, ledger *device.Ledger, strategy string) *MonopolyDevicePlugin {
+	m := NewMonopolyDevicePlugin(path, manager, ledger, strategy)
+	m.resourceName = ResourceDomain + model + "-gpu"
+	m.socket = filepath.Join(path, "flex-nvidia-gpu-"+model+"-monopoly.sock")
+	return m
 }
 
-func (m *MonopolyDevicePlugin) cleanup() {
-	close(m.stop)
-	m.server = nil
-	m.stop = nil
-}
-
-// Start starts the gRPC server, registers the device plugin with the Kubelet,
-// and starts the device healthchecks.
-func (m *MonopolyDevicePlugin) Start() error {
-	m.initialize()
-
-	err := m.Serve()
-	if err != nil {
-		log.Printf("Could not start device plugin for '%s': %s", m.resourceName, err)
-		m.cleanup()
-		return err
-	}
-	log.Printf("Starting to serve '%s' on %s", m.resourceName, m.socket)
-
-	err = m.Register()
-	if err != nil {
-		log.Printf("Could not register device plugin: %s", err)
-		m.Stop()
-		return err
-	}
-	log.Printf("Registered device plugin for '%s' with Kubelet", m.resourceName)
-
-	return nil
-}
-
-// Stop stops the gRPC server.
-func (m *MonopolyDevicePlugin) Stop() error {
-	if m == nil || m.server == nil {
-		return nil
-	}
-	log.Printf("Stopping to serve '%s' on %s", m.resourceName, m.socket)
-	m.server.Stop()
-	if err := os.Remove(m.socket); err != nil && !os.IsNotExist(err) {
-		return err
-	}
-	m.cleanup()
-	return nil
-}
-
-// Serve starts the gRPC server of the device plugin.
-func (m *MonopolyDevicePlugin) Serve() error {
-	os.Remove(m.socket)
-	sock, err := net.Listen("unix", m.socket)
-	if err != nil {
-		return err
-	}
-
-	pluginapi.RegisterDevicePluginServer(m.server, m)
-
-	go func() {
-		lastCrashTime := time.Now()
-		restartCount := 0
-		for {
-			log.Printf("Starting GRPC server for '%s'", m.resourceName)
-			err := m.server.Serve(sock)
-			if err == nil {
-				break
-			}
-
-			log.Printf("GRPC server for '%s' crashed with error: %v", m.resourceName, err)
-
-			// restart if it has not been too often
-			// i.e. if server has crashed more than 5 times and it didn't last more than one hour each time
-			if restartCount > 5 {
-				// quit
-				log.Fatalf("GRPC server for '%s' has repeatedly crashed recently. Quitting", m.resourceName)
-			}
-			timeSinceLastCrash := time.Since(lastCrashTime).Seconds()
-			lastCrashTime = time.Now()
-			if timeSinceLastCrash > 3600 {
-				// it has been one hour since the last crash.. reset the count
-				// to reflect on the frequency
-				restartCount = 1
-			} else {
-				restartCount++
+// ListAndWatch lists devices and update that list according to the health status
+func (m *MonopolyDevicePlugin) ListAndWatch(e *pluginapi.Empty, s pluginapi.DevicePlugin_ListAndWatchServer) error {
+	stop := m.stop
+	updates, cancel := m.manager.Subscribe()
+	defer cancel()
+	ledgerUpdates, cancelLedger := m.ledger.Subscribe()
+	defer cancelLedger()
+
+	var last []*pluginapi.Device
+	sent := false
+	for {
+		devices := m.devices()
+		if !sent || !devicesEqual(last, devices) {
+			if err := s.Send(&pluginapi.ListAndWatchResponse{Devices: devices}); err != nil {
+				return err
 			}
+			last = devices
+			sent = true
 		}
-	}()
-
-	// Wait for server to start by launching a blocking connexion
-	conn, err := m.dial(m.socket, 5*time.Second)
-	if err != nil {
-		return err
-	}
-	conn.Close()
 
-	return nil
-}
-
-// Register registers the device plugin for the given resourceName with Kubelet.
-func (m *MonopolyDevicePlugin) Register() error {
-	conn, err := m.dial(pluginapi.KubeletSocket, 5*time.Second)
-	if err != nil {
-		return err
-	}
-	defer conn.Close()
-
-	client := pluginapi.NewRegistrationClient(conn)
-	reqt := &pluginapi.RegisterRequest{
-		Version:      pluginapi.Version,
-		Endpoint:     path.Base(m.socket),
-		ResourceName: m.resourceName,
-		Options: &pluginapi.DevicePluginOptions{
-			GetPreferredAllocationAvailable: false,
-			PreStartRequired:                false,
-		},
-	}
-
-	_, err = client.Register(context.Background(), reqt)
-	if err != nil {
-		return err
-	}
-	return nil
-}
-
-// GetDevicePluginOptions returns the values of the optional settings for this plugin
-func (m *MonopolyDevicePlugin) GetDevicePluginOptions(context.Context, *pluginapi.Empty) (*pluginapi.DevicePluginOptions, error) {
-	options := &pluginapi.DevicePluginOptions{
-		GetPreferredAllocationAvailable: false,
-		PreStartRequired:                false,
+		select {
+		case <-s.Context().Done():
+			return nil
+		case <-stop:
+			return nil
+		case <-updates:
+		case <-ledgerUpdates:
+		}
 	}
-	return options, nil
 }
 
-// ListAndWatch lists devices and update that list according to the health status
-func (m *MonopolyDevicePlugin) ListAndWatch(e *pluginapi.Empty, s pluginapi.DevicePlugin_ListAndWatchServer) error {
-	devices := m.manager.GetGPUDevs()
-
-	if err := s.Send(&pluginapi.ListAndWatchResponse{Devices: devices}); err != nil {
-		return err
+// devices returns the gpu devices of the manager, with the ones of GPUs which
+// have memory devices allocated reported unhealthy.
+func (m *MonopolyDevicePlugin) devices() []*pluginapi.Device {
+	var devs []*pluginapi.Device
+	for _, dev := range m.manager.GetGPUDevs() {
+		health := dev.Health
+		if idx, err := m.manager.ParseGPUDevID(dev.ID); err == nil && m.ledger.IsShared(idx) {
+			health = pluginapi.Unhealthy
+		}
+		devs = append(devs, &pluginapi.Device{
+			ID:       dev.ID,
+			Health:   health,
+			Topology: dev.Topology,
+		})
 	}
-	<-s.Context().Done()
-	return nil
+	return devs
 }
 
 // GetPreferredAllocation returns the preferred allocation from the set of devices specified in the request
@@ -214,30 +119,56 @@ func (m *MonopolyDevicePlugin) GetPreferredAllocation(ctx context.Context, r *pl
 
 // Allocate which return list of devices.
 func (m *MonopolyDevicePlugin) Allocate(ctx context.Context, reqs *pluginapi.AllocateRequest) (*pluginapi.AllocateResponse, error) {
-	// return empty AllocateResponse will cause kubelet error
-	return &pluginapi.AllocateResponse{
-		ContainerResponses: []*pluginapi.ContainerAllocateResponse{{
-			Envs:        map[string]string{},
-			Mounts:      []*pluginapi.Mount{},
-			Devices:     []*pluginapi.DeviceSpec{},
-			Annotations: map[string]string{},
-		}},
-	}, nil
-}
-
-// PreStartContainer is unimplemented for this plugin
-func (m *MonopolyDevicePlugin) PreStartContainer(context.Context, *pluginapi.PreStartContainerRequest) (*pluginapi.PreStartContainerResponse, error) {
-	return &pluginapi.PreStartContainerResponse{}, nil
-}
+	// IDs are resolved to GPUs first, so that both device ID formats are
+	// accepted whatever the strategy.
+	known := make(map[int]struct{})
+	for _, dev := range m.manager.GetGPUDevs() {
+		if idx, err := m.manager.ParseGPUDevID(dev.ID); err == nil {
+			known[idx] = struct{}{}
+		}
+	}
 
-// dial establishes the gRPC communication with the registered device plugin.
-func (m *MonopolyDevicePlugin) dial(unixSocketPath string, timeout time.Duration) (*grpc.ClientConn, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), timeout)
-	defer cancel()
+	// All containers are validated before the GPUs are claimed at once, so
+	// that a rejected request leaves no claim behind.
+	var containerGPUs [][]device.GPUInfo
+	claims := make(map[int]struct{})
+	for _, req := range reqs.ContainerRequests {
+		indexes := make(map[int]struct{})
+		for _, id := range req.DevicesIDs {
+			idx, err := m.manager.ParseGPUDevID(id)
+			if err != nil {
+				return nil, status.Errorf(codes.InvalidArgument, "invalid allocation request for '%s': %v", m.resourceName, err)
+			}
+			if _, ok := known[idx]; !ok {
+				return nil, status.Errorf(codes.InvalidArgument, "invalid allocation request for '%s': unknown device: %s", m.resourceName, id)
+			}
+			indexes[idx] = struct{}{}
+			claims[idx] = struct{}{}
+		}
 
-	return grpc.DialContext(ctx, unixSocketPath, grpc.WithTransportCredentials(insecure.NewCredentials()), grpc.WithBlock(),
-		grpc.WithContextDialer(func(ctx context.Context, addr string) (net.Conn, error) {
-			return net.DialTimeout("unix", addr, timeout)
-		}),
-	)
+		gpus, err := lookupGPUs(m.manager, sortedIndexes(indexes))
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "allocate '%s': %v", m.resourceName, err)
+		}
+		containerGPUs = append(containerGPUs, gpus)
+	}
+	idxs := sortedIndexes(claims)
+	if err := m.ledger.ClaimExclusive(idxs); err != nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "allocate '%s': %v", m.resourceName, err)
+	}
+	klog.V(6).InfoS("allocate gpu", "gpus", idxs)
+
+	responses := &pluginapi.AllocateResponse{}
+	for _, gpus := range containerGPUs {
+		// return empty ContainerAllocateResponse will cause kubelet error
+		responses.ContainerResponses = append(responses.ContainerResponses, &pluginapi.ContainerAllocateResponse{
+			Envs: map[string]string{
+				VisibleDevicesEnv: visibleDevices(m.strategy, gpus),
+			},
+			Mounts:      []*pluginapi.Mount{},
+			Devices:     deviceSpecs(gpus),
+			Annotations: map[string]string{},
+		})
+	}
+	return responses, nil
 }
@@ -0,0 +1,175 @@
+/*
+ * Copyright 2022 lbf1353@live.com
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package plugin
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/WLBF/flex-gpu-device-plugin/device"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+// testOptions returns the default options of the command line with the
+// device ID strategy.
+func testOptions(strategy string) device.Options {
+	return device.Options{
+		DeviceIDStrategy: strategy,
+		MemoryUnit:       device.DefaultMemoryUnit,
+		OvercommitRatio:  1,
+	}
+}
+
+// newTestManager returns a mock manager of devs, failing t on error.
+func newTestManager(t testing.TB, devs string, opts device.Options) *device.GPUManager {
+	t.Helper()
+	m, err := device.NewMockManager(devs, opts)
+	if err != nil {
+		t.Fatalf("NewMockManager(%q): %v", devs, err)
+	}
+	t.Cleanup(func() { m.Close() })
+	return m
+}
+
+// allocateRequest returns an AllocateRequest of one container per ids.
+func allocateRequest(ids ...[]string) *pluginapi.AllocateRequest {
+	req := &pluginapi.AllocateRequest{}
+	for _, devs := range ids {
+		req.ContainerRequests = append(req.ContainerRequests, &pluginapi.ContainerAllocateRequest{DevicesIDs: devs})
+	}
+	return req
+}
+
+func TestMonopolyAllocateDeviceIDFormats(t *testing.T) {
+	for _, strategy := range []string{device.DeviceIDIndex, device.DeviceIDUUID} {
+		t.Run(strategy, func(t *testing.T) {
+			m := newTestManager(t, "2Gi,2Gi", testOptions(strategy))
+			p := NewMonopolyDevicePlugin(t.TempDir(), m, device.NewLedger(), VisibleDevicesIndex)
+
+			resp, err := p.Allocate(context.Background(), allocateRequest(
+				[]string{"GPU-0"},
+				[]string{"GPU-00000000-0000-0000-0000-000000000001"},
+			))
+			if err != nil {
+				t.Fatalf("Allocate: %v", err)
+			}
+			for i, want := range []string{"0", "1"} {
+				if got := resp.ContainerResponses[i].Envs[VisibleDevicesEnv]; got != want {
+					t.Errorf("container %d: %s = %q, want %q", i, VisibleDevicesEnv, got, want)
+				}
+			}
+
+			if _, err := p.Allocate(context.Background(), allocateRequest([]string{"GPU-2"})); err == nil {
+				t.Errorf("Allocate(GPU-2) succeeded, want unknown device error")
+			}
+		})
+	}
+}
+
+func TestMonopolyAllocateConflict(t *testing.T) {
+	m := newTestManager(t, "2Gi,2Gi", testOptions(device.DeviceIDIndex))
+	ledger := device.NewLedger()
+	if err := ledger.ClaimShared(map[int][]string{1: {"MEM-1-0"}}); err != nil {
+		t.Fatal(err)
+	}
+	p := NewMonopolyDevicePlugin(t.TempDir(), m, ledger, VisibleDevicesIndex)
+
+	_, err := p.Allocate(context.Background(), allocateRequest([]string{"GPU-0"}, []string{"GPU-1"}))
+	if status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("got error %v, want %v", err, codes.FailedPrecondition)
+	}
+	_, err = p.Allocate(context.Background(), allocateRequest([]string{"GPU-0"}, []string{"GPU-2"}))
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("got error %v, want %v", err, codes.InvalidArgument)
+	}
+	if ledger.IsExclusive(0) {
+		t.Errorf("rejected allocation left gpu 0 claimed")
+	}
+}
+
+func TestMonopolyAllocateVisibleDevices(t *testing.T) {
+	tests := []struct {
+		strategy string
+		visible  []string
+	}{
+		{VisibleDevicesIndex, []string{"1", "0,2"}},
+		{VisibleDevicesUUID, []string{
+			"GPU-00000000-0000-0000-0000-000000000001",
+			"GPU-00000000-0000-0000-0000-000000000000,GPU-00000000-0000-0000-0000-000000000002",
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.strategy, func(t *testing.T) {
+			m := newTestManager(t, "2Gi,2Gi,2Gi", testOptions(device.DeviceIDIndex))
+			p := NewMonopolyDevicePlugin(t.TempDir(), m, device.NewLedger(), tt.strategy)
+
+			resp, err := p.Allocate(context.Background(), allocateRequest([]string{"GPU-1"}, []string{"GPU-2", "GPU-0"}))
+			if err != nil {
+				t.Fatalf("Allocate: %v", err)
+			}
+			for i, want := range tt.visible {
+				if got := resp.ContainerResponses[i].Envs[VisibleDevicesEnv]; got != want {
+					t.Errorf("container %d: %s = %q, want %q", i, VisibleDevicesEnv, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestMonopolyAllocateDeviceSpecs(t *testing.T) {
+	var fakes []*device.FakeDevice
+	for i, minor := range []int{0, 3, 5} {
+		fakes = append(fakes, &device.FakeDevice{
+			UUID:              fmt.Sprintf("GPU-00000000-0000-0000-0000-%012d", i),
+			Name:              "Tesla T4",
+			Minor:             minor,
+			Memory:            (16 * device.GiB).Bytes(),
+			PciBusID:          fmt.Sprintf("00000000:%02X:00.0", i+1),
+			NumaNode:          -1,
+			ComputeCapability: [2]int{7, 5},
+		})
+	}
+	m, err := device.NewGPUManagerWithNVML(device.NewFakeNVML(fakes...), testOptions(device.DeviceIDIndex))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	p := NewMonopolyDevicePlugin(t.TempDir(), m, device.NewLedger(), VisibleDevicesIndex)
+
+	resp, err := p.Allocate(context.Background(), allocateRequest([]string{"GPU-1"}, []string{"GPU-2", "GPU-0"}))
+	if err != nil {
+		t.Fatalf("Allocate: %v", err)
+	}
+	for i, want := range []string{
+		"[/dev/nvidiactl /dev/nvidia-uvm /dev/nvidia3]",
+		"[/dev/nvidiactl /dev/nvidia-uvm /dev/nvidia0 /dev/nvidia5]",
+	} {
+		var paths []string
+		for _, spec := range resp.ContainerResponses[i].Devices {
+			if spec.HostPath != spec.ContainerPath || spec.Permissions != "rw" {
+				t.Errorf("container %d: got device spec %v, want %s mounted rw at the same path", i, spec, spec.HostPath)
+			}
+			paths = append(paths, spec.HostPath)
+		}
+		if got := fmt.Sprint(paths); got != want {
+			t.Errorf("container %d: got device nodes %s, want %s", i, got, want)
+		}
+	}
+}
@@ -18,9 +18,56 @@ package plugin
 
 import (
 	"context"
+	"fmt"
+	"github.com/WLBF/flex-gpu-device-plugin/device"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"log"
+	"net"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc"
 	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
 )
 
+// ResourceDomain is the prefix of all resource names of the device plugins.
+const ResourceDomain = "nvidia.flex.com/"
+
+const (
+	// VisibleDevicesEnv is consumed by the nvidia container runtime to decide
+	// which GPUs are exposed to the container.
+	VisibleDevicesEnv = "NVIDIA_VISIBLE_DEVICES"
+	// MemoryLimitEnv holds the amount of GPU memory in MiB granted to the
+	// container.
+	MemoryLimitEnv = "FLEX_GPU_MEMORY_LIMIT"
+	// CoreLimitEnv holds the percentage of the streaming multiprocessors of
+	// the GPU granted to the container, to be enforced by an interposer.
+	CoreLimitEnv = "FLEX_GPU_CORE_LIMIT"
+	// MPSThreadPercentageEnv limits the streaming multiprocessors available to
+	// the container when the GPU runs the CUDA MPS server.
+	MPSThreadPercentageEnv = "CUDA_MPS_ACTIVE_THREAD_PERCENTAGE"
+	// OvercommitRatioEnv holds the overcommit ratio of the GPU memory when
+	// it is overcommitted, in which case the memory limit may exceed the
+	// memory physically available to the container.
+	OvercommitRatioEnv = "FLEX_GPU_MEMORY_OVERCOMMIT_RATIO"
+	// OvercommitRatioAnnotation is the annotation counterpart of
+	// OvercommitRatioEnv, passed to the container runtime.
+	OvercommitRatioAnnotation = ResourceDomain + "memory-overcommit-ratio"
+)
+
+const (
+	// VisibleDevicesIndex exposes GPUs to containers by index.
+	VisibleDevicesIndex = "index"
+	// VisibleDevicesUUID exposes GPUs to containers by UUID.
+	VisibleDevicesUUID = "uuid"
+)
+
 type DevicePlugin interface {
 	Start() error
 	Stop() error
@@ -32,3 +79,363 @@ type DevicePlugin interface {
 	Allocate(ctx context.Context, reqs *pluginapi.AllocateRequest) (*pluginapi.AllocateResponse, error)
 	PreStartContainer(context.Context, *pluginapi.PreStartContainerRequest) (*pluginapi.PreStartContainerResponse, error)
 }
+
+// pluginServer runs the gRPC server of a device plugin and registers it with
+// Kubelet. It is embedded by the device plugins, which implement the rest of
+// the device plugin service.
+type pluginServer struct {
+	resourceName string
+	socket       string
+	// preferredAllocation tells Kubelet whether the service implements
+	// GetPreferredAllocation.
+	preferredAllocation bool
+	// preStartRequired tells Kubelet whether the service implements
+	// PreStartContainer.
+	preStartRequired bool
+	service          pluginapi.DevicePluginServer
+
+	server *grpc.Server
+	stop   chan interface{}
+}
+
+// newPluginServer returns a pluginServer serving service for resourceName on
+// socket.
+func newPluginServer(resourceName, socket string, preferredAllocation bool, service pluginapi.DevicePluginServer) pluginServer {
+	return pluginServer{
+		resourceName:        resourceName,
+		socket:              socket,
+		preferredAllocation: preferredAllocation,
+		service:             service,
+
+		// These will be reinitialized every
+		// time the plugin server is restarted.
+		server: nil,
+		stop:   nil,
+	}
+}
+
+func (m *pluginServer) initialize() {
+	m.server = grpc.NewServer([]grpc.ServerOption{}...)
+	m.stop = make(chan interface{})
+}
+
+func (m *pluginServer) cleanup() {
+	close(m.stop)
+	m.server = nil
+	m.stop = nil
+}
+
+// Start starts the gRPC server, registers the device plugin with the Kubelet,
+// and starts the device healthchecks.
+func (m *pluginServer) Start() error {
+	m.initialize()
+
+	err := m.Serve()
+	if err != nil {
+		log.Printf("Could not start device plugin for '%s': %s", m.resourceName, err)
+		m.cleanup()
+		return err
+	}
+	log.Printf("Starting to serve '%s' on %s", m.resourceName, m.socket)
+
+	err = m.Register()
+	if err != nil {
+		log.Printf("Could not register device plugin: %s", err)
+		m.Stop()
+		return err
+	}
+	log.Printf("Registered device plugin for '%s' with Kubelet", m.resourceName)
+
+	return nil
+}
+
+// Stop stops the gRPC server.
+func (m *pluginServer) Stop() error {
+	if m == nil || m.server == nil {
+		return nil
+	}
+	log.Printf("Stopping to serve '%s' on %s", m.resourceName, m.socket)
+	m.server.Stop()
+	if err := os.Remove(m.socket); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	m.cleanup()
+	return nil
+}
+
+// Serve starts the gRPC server of the device plugin.
+func (m *pluginServer) Serve() error {
+	os.Remove(m.socket)
+	sock, err := net.Listen("unix", m.socket)
+	if err != nil {
+		return err
+	}
+
+	pluginapi.RegisterDevicePluginServer(m.server, m.service)
+
+	go func() {
+		lastCrashTime := time.Now()
+		restartCount := 0
+		for {
+			log.Printf("Starting GRPC server for '%s'", m.resourceName)
+			err := m.server.Serve(sock)
+			if err == nil {
+				break
+			}
+
+			log.Printf("GRPC server for '%s' crashed with error: %v", m.resourceName, err)
+
+			// restart if it has not been too often
+			// i.e. if server has crashed more than 5 times and it didn't last more than one hour each time
+			if restartCount > 5 {
+				// quit
+				log.Fatalf("GRPC server for '%s' has repeatedly crashed recently. Quitting", m.resourceName)
+			}
+			timeSinceLastCrash := time.Since(lastCrashTime).Seconds()
+			lastCrashTime = time.Now()
+			if timeSinceLastCrash > 3600 {
+				// it has been one hour since the last crash.. reset the count
+				// to reflect on the frequency
+				restartCount = 1
+			} else {
+				restartCount++
+			}
+		}
+	}()
+
+	// Wait for server to start by launching a blocking connexion
+	conn, err := m.dial(m.socket, 5*time.Second)
+	if err != nil {
+		return err
+	}
+	conn.Close()
+
+	return nil
+}
+
+// Register registers the device plugin for the given resourceName with Kubelet.
+func (m *pluginServer) Register() error {
+	conn, err := m.dial(pluginapi.KubeletSocket, 5*time.Second)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	client := pluginapi.NewRegistrationClient(conn)
+	reqt := &pluginapi.RegisterRequest{
+		Version:      pluginapi.Version,
+		Endpoint:     path.Base(m.socket),
+		ResourceName: m.resourceName,
+		Options: &pluginapi.DevicePluginOptions{
+			GetPreferredAllocationAvailable: m.preferredAllocation,
+			PreStartRequired:                m.preStartRequired,
+		},
+	}
+
+	_, err = client.Register(context.Background(), reqt)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// GetDevicePluginOptions returns the values of the optional settings for this plugin
+func (m *pluginServer) GetDevicePluginOptions(context.Context, *pluginapi.Empty) (*pluginapi.DevicePluginOptions, error) {
+	options := &pluginapi.DevicePluginOptions{
+		GetPreferredAllocationAvailable: m.preferredAllocation,
+		PreStartRequired:                m.preStartRequired,
+	}
+	return options, nil
+}
+
+// PreStartContainer is unimplemented for this plugin
+func (m *pluginServer) PreStartContainer(context.Context, *pluginapi.PreStartContainerRequest) (*pluginapi.PreStartContainerResponse, error) {
+	return &pluginapi.PreStartContainerResponse{}, nil
+}
+
+// dial establishes the gRPC communication with the registered device plugin.
+func (m *pluginServer) dial(unixSocketPath string, timeout time.Duration) (*grpc.ClientConn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	return grpc.DialContext(ctx, unixSocketPath, grpc.WithTransportCredentials(insecure.NewCredentials()), grpc.WithBlock(),
+		grpc.WithContextDialer(func(ctx context.Context, addr string) (net.Conn, error) {
+			return net.DialTimeout("unix", addr, timeout)
+		}),
+	)
+}
+
+// ValidateVisibleDevicesStrategy checks that strategy is a known NVIDIA_VISIBLE_DEVICES strategy.
+func ValidateVisibleDevicesStrategy(strategy string) error {
+	switch strategy {
+	case VisibleDevicesIndex, VisibleDevicesUUID:
+		return nil
+	}
+	return fmt.Errorf("unknown visible devices strategy: %s", strategy)
+}
+
+// lookupGPUs returns the metadata of the GPUs at indexes.
+func lookupGPUs(manager device.Manager, indexes []int) ([]device.GPUInfo, error) {
+	var gpus []device.GPUInfo
+	for _, idx := range indexes {
+		gpu, err := manager.GetGPU(idx)
+		if err != nil {
+			return nil, err
+		}
+		gpus = append(gpus, gpu)
+	}
+	return gpus, nil
+}
+
+// claimShared validates the memory or core devices requested by every
+// container of reqs with validate, then claims them all at once in ledger so
+// that a rejected request leaves no claim behind. It returns the GPU of every
+// container.
+func claimShared(manager device.Manager, ledger *device.Ledger, resourceName string, reqs *pluginapi.AllocateRequest,
+	validate func(device.Manager, []string) (int, error)) ([]device.GPUInfo, error) {
+	claims := make(map[int][]string)
+	var gpus []device.GPUInfo
+	for _, req := range reqs.ContainerRequests {
+		idx, err := validate(manager, req.DevicesIDs)
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid allocation request for '%s': %v", resourceName, err)
+		}
+		gpu, err := manager.GetGPU(idx)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "allocate '%s': %v", resourceName, err)
+		}
+		claims[idx] = append(claims[idx], req.DevicesIDs...)
+		gpus = append(gpus, gpu)
+	}
+	if err := ledger.ClaimShared(claims); err != nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "allocate '%s': %v", resourceName, err)
+	}
+	return gpus, nil
+}
+
+// visibleDevices returns the NVIDIA_VISIBLE_DEVICES value for the given GPUs.
+func visibleDevices(strategy string, gpus []device.GPUInfo) string {
+	var strs []string
+	for _, gpu := range gpus {
+		if strategy == VisibleDevicesUUID {
+			strs = append(strs, gpu.UUID)
+		} else {
+			strs = append(strs, strconv.Itoa(gpu.Index))
+		}
+	}
+	return strings.Join(strs, ",")
+}
+
+// visibleMigDevices returns the NVIDIA_VISIBLE_DEVICES value for the given MIG
+// devices, <gpu index>:<mig index> or the MIG device UUIDs.
+func visibleMigDevices(strategy string, migs []device.MigInfo) string {
+	var strs []string
+	for _, mig := range migs {
+		if strategy == VisibleDevicesUUID {
+			strs = append(strs, mig.UUID)
+		} else {
+			strs = append(strs, fmt.Sprintf("%d:%d", mig.Parent, mig.Index))
+		}
+	}
+	return strings.Join(strs, ",")
+}
+
+// deviceSpecs returns the device nodes required to use the given GPUs, none
+// for GPUs without device node such as mock GPUs.
+func deviceSpecs(gpus []device.GPUInfo) []*pluginapi.DeviceSpec {
+	var paths []string
+	for _, gpu := range gpus {
+		if gpu.Minor >= 0 {
+			paths = append(paths, fmt.Sprintf("/dev/nvidia%d", gpu.Minor))
+		}
+	}
+	if len(paths) == 0 {
+		return nil
+	}
+	paths = append([]string{"/dev/nvidiactl", "/dev/nvidia-uvm"}, paths...)
+
+	var specs []*pluginapi.DeviceSpec
+	for _, p := range paths {
+		specs = append(specs, &pluginapi.DeviceSpec{
+			ContainerPath: p,
+			HostPath:      p,
+			Permissions:   "rw",
+		})
+	}
+	return specs
+}
+
+// colocationHint returns the GPU the latest shared allocation landed on if it
+// was of devices of another resource, as reported by other, -1 otherwise.
+// Kubelet allocates the resources of a container one after the other, so the
+// allocation of a resource right after another is preferred on the same GPU
+// in case they are the same container's.
+func colocationHint(ledger *device.Ledger, other func(id string) bool) int {
+	latest := ledger.LatestShared()
+	if len(latest) != 1 {
+		return -1
+	}
+	for idx, ids := range latest {
+		if len(ids) != 0 && other(ids[0]) {
+			return idx
+		}
+	}
+	return -1
+}
+
+// withExclusiveUnhealthy returns all, the memory or core devices of manager,
+// with the devices of the exclusively allocated GPUs, as returned by devsOf,
+// reported unhealthy. all is returned as is if no GPU is allocated
+// exclusively.
+func withExclusiveUnhealthy(manager device.Manager, ledger *device.Ledger, all []*pluginapi.Device, devsOf func(int) []*pluginapi.Device) []*pluginapi.Device {
+	gpus := manager.GetGPUs()
+	exclusive := make(map[int]struct{})
+	for _, gpu := range gpus {
+		if ledger.IsExclusive(gpu.Index) {
+			exclusive[gpu.Index] = struct{}{}
+		}
+	}
+	if len(exclusive) == 0 {
+		return all
+	}
+
+	devs := make([]*pluginapi.Device, 0, len(all))
+	for _, gpu := range gpus {
+		if _, ok := exclusive[gpu.Index]; !ok {
+			devs = append(devs, devsOf(gpu.Index)...)
+			continue
+		}
+		for _, dev := range devsOf(gpu.Index) {
+			devs = append(devs, &pluginapi.Device{
+				ID:       dev.ID,
+				Health:   pluginapi.Unhealthy,
+				Topology: dev.Topology,
+			})
+		}
+	}
+	return devs
+}
+
+// sortedIndexes returns the keys of a GPU index set in ascending order.
+func sortedIndexes(set map[int]struct{}) []int {
+	var indexes []int
+	for idx := range set {
+		indexes = append(indexes, idx)
+	}
+	sort.Ints(indexes)
+	return indexes
+}
+
+// devicesEqual reports whether two device lists have the same devices in the
+// same order and with the same health.
+func devicesEqual(a, b []*pluginapi.Device) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].ID != b[i].ID || a[i].Health != b[i].Health {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,148 @@
+/*
+ * Copyright 2022 lbf1353@live.com
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package plugin
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/WLBF/flex-gpu-device-plugin/device"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+	podresourcesapi "k8s.io/kubelet/pkg/apis/podresources/v1"
+)
+
+// fakeListAndWatchServer queues the responses sent by ListAndWatch.
+type fakeListAndWatchServer struct {
+	grpc.ServerStream
+	ctx       context.Context
+	responses chan *pluginapi.ListAndWatchResponse
+}
+
+func newFakeListAndWatchServer(ctx context.Context) *fakeListAndWatchServer {
+	return &fakeListAndWatchServer{
+		ctx:       ctx,
+		responses: make(chan *pluginapi.ListAndWatchResponse, 16),
+	}
+}
+
+func (s *fakeListAndWatchServer) Send(resp *pluginapi.ListAndWatchResponse) error {
+	s.responses <- resp
+	return nil
+}
+
+func (s *fakeListAndWatchServer) Context() context.Context {
+	return s.ctx
+}
+
+// recv returns the next device list sent, failing t if none is sent in time.
+func (s *fakeListAndWatchServer) recv(t *testing.T) map[string]string {
+	t.Helper()
+	select {
+	case resp := <-s.responses:
+		health := make(map[string]string)
+		for _, dev := range resp.Devices {
+			health[dev.ID] = dev.Health
+		}
+		return health
+	case <-time.After(5 * time.Second):
+		t.Fatal("no device list sent")
+		return nil
+	}
+}
+
+// fakePodResourcesServer lists the same pod resources over and over.
+type fakePodResourcesServer struct {
+	podresourcesapi.UnimplementedPodResourcesListerServer
+	resp *podresourcesapi.ListPodResourcesResponse
+}
+
+func (s *fakePodResourcesServer) List(context.Context, *podresourcesapi.ListPodResourcesRequest) (*podresourcesapi.ListPodResourcesResponse, error) {
+	return s.resp, nil
+}
+
+// servePodResources serves pods through the pod resources API until t ends,
+// and returns the socket.
+func servePodResources(t *testing.T, pods ...*podresourcesapi.PodResources) string {
+	t.Helper()
+	socket := filepath.Join(t.TempDir(), "kubelet.sock")
+	lis, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := grpc.NewServer()
+	podresourcesapi.RegisterPodResourcesListerServer(server, &fakePodResourcesServer{
+		resp: &podresourcesapi.ListPodResourcesResponse{PodResources: pods},
+	})
+	go server.Serve(lis)
+	t.Cleanup(server.Stop)
+	return socket
+}
+
+// podResources returns a pod of one container per resources, named after
+// their index, with the devices of every resource name.
+func podResources(name string, resources ...map[string][]string) *podresourcesapi.PodResources {
+	pod := &podresourcesapi.PodResources{Name: name, Namespace: "default"}
+	for i, devs := range resources {
+		container := &podresourcesapi.ContainerResources{Name: fmt.Sprintf("c%d", i)}
+		for resourceName, ids := range devs {
+			container.Devices = append(container.Devices, &podresourcesapi.ContainerDevices{ResourceName: resourceName, DeviceIds: ids})
+		}
+		pod.Containers = append(pod.Containers, container)
+	}
+	return pod
+}
+
+func TestPluginServerServe(t *testing.T) {
+	m := newTestManager(t, "2Gi,2Gi", testOptions(device.DeviceIDIndex))
+	ledger := device.NewLedger()
+	dir := t.TempDir()
+	mono := NewMonopolyDevicePlugin(dir, m, ledger, VisibleDevicesIndex)
+	memory := NewMemoryDevicePlugin(dir, m, ledger, device.BinpackPolicy{}, VisibleDevicesIndex)
+	core := NewCoreDevicePlugin(dir, m, ledger, device.BinpackPolicy{}, VisibleDevicesIndex)
+	for i, s := range []*pluginServer{&mono.pluginServer, &memory.pluginServer, &core.pluginServer} {
+		s.initialize()
+		if err := s.Serve(); err != nil {
+			t.Fatalf("Serve %s: %v", s.resourceName, err)
+		}
+
+		conn, err := s.dial(s.socket, time.Second)
+		if err != nil {
+			t.Fatalf("dial %s: %v", s.resourceName, err)
+		}
+		opts, err := pluginapi.NewDevicePluginClient(conn).GetDevicePluginOptions(context.Background(), &pluginapi.Empty{})
+		conn.Close()
+		if err != nil {
+			t.Fatalf("GetDevicePluginOptions %s: %v", s.resourceName, err)
+		}
+		if want := i != 0; opts.GetPreferredAllocationAvailable != want {
+			t.Errorf("%s: GetPreferredAllocationAvailable = %v, want %v", s.resourceName, opts.GetPreferredAllocationAvailable, want)
+		}
+
+		if err := s.Stop(); err != nil {
+			t.Fatalf("Stop %s: %v", s.resourceName, err)
+		}
+		if _, err := os.Stat(s.socket); !os.IsNotExist(err) {
+			t.Errorf("%s: socket %s left behind: %v", s.resourceName, s.socket, err)
+		}
+	}
+}
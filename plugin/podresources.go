@@ -0,0 +1,175 @@
+/*
+ * Copyright 2022 lbf1353@live.com
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package plugin
+
+import (
+	"github.com/WLBF/flex-gpu-device-plugin/device"
+	"google.golang.org/grpc/credentials/insecure"
+	"k8s.io/klog/v2"
+	"log"
+	"net"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	podresourcesapi "k8s.io/kubelet/pkg/apis/podresources/v1"
+)
+
+const (
+	PodResourcesSocket       = "/var/lib/kubelet/pod-resources/kubelet.sock"
+	PodResourcesSyncInterval = 10 * time.Second
+)
+
+// SyncLedger keeps ledger in line with the devices kubelet reports in use
+// through the pod resources API, until stop is closed. Device plugins are not
+// notified when a pod releases its devices, so this is how claims are dropped.
+func SyncLedger(ledger *device.Ledger, manager device.Manager, socket string, interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := syncLedger(ledger, manager, socket); err != nil {
+			log.Printf("Failed to sync allocation ledger with kubelet: %v", err)
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func syncLedger(ledger *device.Ledger, manager device.Manager, socket string) error {
+	allocs, err := listAllocations(manager, socket)
+	if err != nil {
+		return err
+	}
+
+	klog.V(6).InfoS("sync allocation ledger", "exclusive", allocs.exclusive, "shared", len(allocs.shared))
+	ledger.Sync(allocs.exclusive, allocs.shared)
+	return nil
+}
+
+// GPUsInUse returns the indexes of the GPUs with devices in use according to
+// kubelet.
+func GPUsInUse(manager device.Manager, socket string) (map[int]struct{}, error) {
+	allocs, err := listAllocations(manager, socket)
+	if err != nil {
+		return nil, err
+	}
+
+	inUse := make(map[int]struct{})
+	for _, idx := range allocs.exclusive {
+		inUse[idx] = struct{}{}
+	}
+	for idx := range allocs.shared {
+		inUse[idx] = struct{}{}
+	}
+	for _, idx := range allocs.mig {
+		inUse[idx] = struct{}{}
+	}
+	return inUse, nil
+}
+
+// allocations are the devices of manager in use according to kubelet.
+type allocations struct {
+	// exclusive are the indexes of the GPUs allocated exclusively.
+	exclusive []int
+	// shared are the memory and core devices in use by GPU index.
+	shared map[int][]string
+	// mig are the indexes of the parent GPUs of the MIG devices in use.
+	mig []int
+}
+
+func listAllocations(manager device.Manager, socket string) (*allocations, error) {
+	resp, err := listPodResources(socket)
+	if err != nil {
+		return nil, err
+	}
+
+	allocs := &allocations{shared: make(map[int][]string)}
+	for _, pod := range resp.PodResources {
+		for _, container := range pod.Containers {
+			for _, devs := range container.Devices {
+				if !strings.HasPrefix(devs.ResourceName, ResourceDomain) {
+					continue
+				}
+				for _, id := range devs.DeviceIds {
+					if idx, err := manager.ParseGPUDevID(id); err == nil {
+						allocs.exclusive = append(allocs.exclusive, idx)
+					} else if idx, _, err := manager.ParseMemoryDevID(id); err == nil {
+						allocs.shared[idx] = append(allocs.shared[idx], id)
+					} else if idx, _, err := manager.ParseCoreDevID(id); err == nil {
+						allocs.shared[idx] = append(allocs.shared[idx], id)
+					} else if mig, err := manager.ParseMigDevID(id); err == nil {
+						allocs.mig = append(allocs.mig, mig.Parent)
+					} else {
+						klog.V(4).InfoS("skip unknown device", "resource", devs.ResourceName, "id", id)
+					}
+				}
+			}
+		}
+	}
+	return allocs, nil
+}
+
+// findContainer returns the pod and the container which device id of
+// resourceName is assigned to according to kubelet, nil if none is.
+func findContainer(socket, resourceName, id string) (*podresourcesapi.PodResources, *podresourcesapi.ContainerResources, error) {
+	resp, err := listPodResources(socket)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for _, pod := range resp.PodResources {
+		for _, container := range pod.Containers {
+			for _, devs := range container.Devices {
+				if devs.ResourceName != resourceName {
+					continue
+				}
+				for _, devID := range devs.DeviceIds {
+					if devID == id {
+						return pod, container, nil
+					}
+				}
+			}
+		}
+	}
+	return nil, nil, nil
+}
+
+// listPodResources lists the resources of the pods of the node through the
+// kubelet pod resources API on socket.
+func listPodResources(socket string) (*podresourcesapi.ListPodResourcesResponse, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	conn, err := grpc.DialContext(ctx, socket, grpc.WithTransportCredentials(insecure.NewCredentials()), grpc.WithBlock(),
+		grpc.WithContextDialer(func(ctx context.Context, addr string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", addr)
+		}),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	client := podresourcesapi.NewPodResourcesListerClient(conn)
+	return client.List(ctx, &podresourcesapi.ListPodResourcesRequest{})
+}